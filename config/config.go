@@ -46,8 +46,10 @@ func (c Config) nestedMerge(object map[string]interface{}, prefix string) {
 	}
 
 	for k, v := range object {
-		if reflect.TypeOf(v).Kind() == reflect.Map {
-			// if 'v' is a map of interface{}, recursively add.
+		if v != nil && reflect.TypeOf(v).Kind() == reflect.Map {
+			// if 'v' is a map of interface{}, recursively add. The object itself is also available by its
+			// key, so that its properties can be enumerated.
+			c[p+k] = v
 			c.nestedMerge(v.(map[string]interface{}), p+k)
 		} else {
 			// otherwise just add the property, using the prefix
@@ -49,6 +49,7 @@ func (c *ContentControllerStruct) SetContext(ctx interface{}) {
 }
 func (c *ContentControllerStruct) SetObject(obj interface{}) {
 	c.Fallback = obj
+	c.page = obj
 }
 
 func (c *ContentControllerStruct) GetObject() interface{} {
@@ -56,12 +57,12 @@ func (c *ContentControllerStruct) GetObject() interface{} {
 }
 
 // Given a request, follow the segments through sitetree to find the page that is being requested. Doesn't
-// understand actions, so just finds the page. Returns ID of SiteTree_Live record or 0 if it can't find a
+// understand actions, so just finds the page. Returns ID of live SiteTree record or 0 if it can't find a
 // matching page.
 // @todo Understand BaseController actions, or break on the furthest it gets up the tree
 // @todo cache site tree
-func findPageToRender(r *http.Request) (int, error) {
-	siteCache := getSiteCache()
+func findPageToRender(db *orm.Database, r *http.Request) (int, error) {
+	siteCache := getSiteCache(db)
 	if siteCache != nil {
 		id, found := siteCache.findPageToRender(r)
 		if found {
@@ -75,40 +76,32 @@ func findPageToRender(r *http.Request) (int, error) {
 
 	if len(path) == 0 || path[0] == "" {
 		// find a home page ID
-		r, e := orm.Query("select \"ID\" from \"SiteTree_Live\" where \"URLSegment\"='home' and \"ParentID\"=0")
-		defer r.Close()
+		path = []string{"home"}
+	}
 
+	sql := "select \"ID\" from \"" + db.TableForMode("SiteTree", orm.Live) + "\" where \"URLSegment\"=? and \"ParentID\"=?"
+	currParentID := 0
+	for _, p := range path {
+		rows, e := db.Query(sql, p, currParentID)
 		if e != nil {
 			return 0, e
 		}
-		if !r.Next() {
+
+		if !rows.Next() {
+			rows.Close()
 			return 0, nil
 		}
 
 		var ID int
-		e = r.Scan(&ID)
-
-		return ID, e
-	}
-
-	currParentID := 0
-	for _, p := range path {
-		r, e := orm.Query("select \"ID\",\"ParentID\" from \"SiteTree_Live\" where \"URLSegment\"='" + p + "' and \"ParentID\"=" + strconv.Itoa(currParentID))
-		defer r.Close()
-
+		e = rows.Scan(&ID)
+		rows.Close()
 		if e != nil {
 			return 0, e
 		}
-		if !r.Next() {
-			return 0, nil
-		}
-
-		var ID, ParentID int
-		e = r.Scan(&ID, &ParentID)
 		currParentID = ID
 	}
 
-	// if we get to the end, we've found a matching ID in SiteTree_Live
+	// if we get to the end, we've found a matching ID in live SiteTree
 	return currParentID, nil
 }
 
@@ -123,8 +116,27 @@ func findNotFoundPage(r *http.Request) (int, error) {
 // - if there is no matching page, find an error page instead
 // - with the page in sitetree located, use ClassName to determine the controller that should be invoked.
 // - grab the data object and render the template with it.
+// Pages are read from the default database.
 func SiteTreeHandler(w http.ResponseWriter, r *http.Request) {
-	pageID, e := findPageToRender(r)
+	serveSiteTree(orm.GetDatabase(orm.DefaultDatabase), w, r)
+}
+
+// SiteTreeHandlerFor returns a handler like SiteTreeHandler that reads pages from the given database.
+// Controllers that embed BaseController are bound to the database, so their menus, site config and the
+// relations of their pages also come from it.
+func SiteTreeHandlerFor(db *orm.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveSiteTree(db, w, r)
+	}
+}
+
+func serveSiteTree(db *orm.Database, w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		ErrorHandler(w, errNoDatabase)
+		return
+	}
+
+	pageID, e := findPageToRender(db, r)
 	if e != nil {
 		ErrorHandler(w, e)
 		return
@@ -148,40 +160,23 @@ func SiteTreeHandler(w http.ResponseWriter, r *http.Request) {
 
 	//	fmt.Printf("SiteTreeHandler has found a page: %d\n", pageID)
 
-	siteCache := getSiteCache()
-	page := siteCache.GetCacheByID(pageID)
+	page, e := getPage(db, pageID)
+	if e != nil {
+		ErrorHandler(w, e)
+		return
+	}
 
 	if page == nil {
-		q := orm.NewQuery("SiteTree").Where("\"SiteTree_Live\".\"ID\"=" + strconv.Itoa(pageID))
-		v, _ := q.Run()
-
-		if e != nil {
-			ErrorHandler(w, e)
-			return
-		}
-
-		res := v.(orm.DataList)
-		items, e := res.Items()
-		if e != nil {
-			ErrorHandler(w, e)
-		}
-
-		if len(items) == 0 {
-			e = errors.New("Could not locate object with ID " + strconv.Itoa(pageID))
-			ErrorHandler(w, e)
-			return
-		}
-
-		page = items[0]
-
-		siteCache.CacheDataObject(pageID, page)
+		e = errors.New("Could not locate object with ID " + strconv.Itoa(pageID))
+		ErrorHandler(w, e)
+		return
 	}
 
-	renderWithMatchedController(w, r, page)
+	renderWithMatchedController(db, w, r, page)
 }
 
 // Given a page, find a controller that says it can handle it, and render the page with that.
-func renderWithMatchedController(w http.ResponseWriter, r *http.Request, page interface{}) {
+func renderWithMatchedController(db *orm.Database, w http.ResponseWriter, r *http.Request, page interface{}) {
 	// locate a controller%s\n", page)
 	className := data.Eval(page, "ClassName").(string)
 	c, e := getControllerInstance(className)
@@ -191,6 +186,11 @@ func renderWithMatchedController(w http.ResponseWriter, r *http.Request, page in
 		return
 	}
 
+	// bind the controller to the database the page came from.
+	if dc, ok := c.(orm.DatabaseObject); ok {
+		dc.SetDatabase(db)
+	}
+
 	c.Init(r)
 
 	// if the controller is a ContentController then set the object.
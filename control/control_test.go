@@ -1 +1,313 @@
 package control
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"github.com/mrmorphic/goss"
+	"github.com/mrmorphic/goss/cache"
+	"github.com/mrmorphic/goss/config"
+	"github.com/mrmorphic/goss/orm"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSiteCache returns a site cache for a small site tree:
+//
+//	home (1)
+//	about (2, hidden from menus)
+//		team (4)
+//			alice (6)
+//		history (5, hidden from search)
+//	contact (3)
+func testSiteCache() *SiteCache {
+	c := newSiteCache(nil)
+	entries := []*siteCacheEntry{
+		{ID: 1, URLSegment: "home", ShowInMenus: true, ShowInSearch: true, Sort: 1},
+		{ID: 2, URLSegment: "about", ShowInSearch: true, Sort: 2},
+		{ID: 3, URLSegment: "contact", ShowInMenus: true, ShowInSearch: true, Sort: 3},
+		{ID: 4, ParentID: 2, URLSegment: "team", ShowInMenus: true, ShowInSearch: true, Sort: 2},
+		{ID: 5, ParentID: 2, URLSegment: "history", ShowInMenus: true, Sort: 1},
+		{ID: 6, ParentID: 4, URLSegment: "alice", ShowInMenus: true, ShowInSearch: true, Sort: 1},
+	}
+	for _, entry := range entries {
+		c.raw = append(c.raw, entry)
+		c.byID[entry.ID] = entry
+	}
+	c.derivePaths()
+	c.deriveChildren()
+	return c
+}
+
+func TestSiteCacheHierarchy(t *testing.T) {
+	c := testSiteCache()
+
+	if p := c.paths["about/team/alice"]; p == nil || p.ID != 6 {
+		t.Errorf("Expected path of nested page, got %v", p)
+	}
+
+	childTests := []struct {
+		parentID int
+		which    childFilter
+		expected []int
+	}{
+		{0, menuChildren, []int{1, 3}},
+		{0, allChildren, []int{1, 2, 3}},
+		{2, menuChildren, []int{5, 4}},
+		{2, searchChildren, []int{4}},
+		{6, allChildren, []int{}},
+	}
+	for _, test := range childTests {
+		if ids := c.childIDs(test.parentID, test.which); !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("Expected children of %d to be %v, got %v", test.parentID, test.expected, ids)
+		}
+	}
+
+	var ids []int
+	for _, entry := range c.ancestry(6) {
+		ids = append(ids, entry.ID)
+	}
+	if !reflect.DeepEqual(ids, []int{2, 4, 6}) {
+		t.Errorf("Unexpected ancestry %v", ids)
+	}
+	if len(c.ancestry(99)) != 0 {
+		t.Errorf("Expected no ancestry for a page that isn't cached")
+	}
+}
+
+func TestPartialSiteCache(t *testing.T) {
+	// without a site tree TTL, the cache isn't primed, which would query the database
+	db := &orm.Database{Name: "partial"}
+	c := getSiteCache(db)
+	if c == nil || !c.partial || len(c.raw) != 0 {
+		t.Fatalf("Expected an empty partial cache, got %v", c)
+	}
+
+	// entries and children that have been read are used without querying
+	full := testSiteCache()
+	for id, entry := range full.byID {
+		c.byID[id] = entry
+	}
+	c.children[2] = full.children[2]
+	if ids := c.childIDs(2, menuChildren); !reflect.DeepEqual(ids, []int{5, 4}) {
+		t.Errorf("Unexpected children %v", ids)
+	}
+	if ancestry := c.ancestry(6); len(ancestry) != 3 {
+		t.Errorf("Unexpected ancestry %v", ancestry)
+	}
+}
+
+func TestMenuParent(t *testing.T) {
+	c := testSiteCache()
+
+	tests := []struct {
+		id, level int
+		parentID  int
+		ok        bool
+	}{
+		{6, 1, 0, true},
+		{6, 2, 2, true},
+		{6, 3, 4, true},
+		{6, 4, 6, true},
+		{6, 5, 0, false},
+		{3, 2, 3, true},
+		{3, 3, 0, false},
+		{3, 0, 0, false},
+	}
+	for _, test := range tests {
+		parentID, ok := c.menuParent(test.id, test.level)
+		if parentID != test.parentID || ok != test.ok {
+			t.Errorf("Expected menu %d of page %d to be children of %d (%v), got %d (%v)", test.level, test.id, test.parentID, test.ok, parentID, ok)
+		}
+	}
+}
+
+func TestAncestorSegments(t *testing.T) {
+	db := &orm.Database{Name: "segments"}
+	cache.Store("goss.Sitetree."+db.Name, testSiteCache(), time.Minute)
+
+	tests := map[int]string{1: "home", 4: "about/team", 6: "about/team/alice"}
+	for id, expected := range tests {
+		if s, ok := ancestorSegments(db, id); !ok || s != expected {
+			t.Errorf("Expected segments of %d to be %s, got %s", id, expected, s)
+		}
+	}
+}
+
+func TestNoDatabase(t *testing.T) {
+	// there is no default database in these tests
+	ctl := &BaseController{}
+	if list, e := ctl.Menu(1); e != errNoDatabase || list != nil {
+		t.Errorf("Expected no menu without a database, got %v, %v", list, e)
+	}
+	if _, e := ctl.SiteConfig(); e != errNoDatabase {
+		t.Errorf("Expected no site config without a database, got %v", e)
+	}
+	if getSiteCache(nil) != nil {
+		t.Errorf("Expected no site cache without a database")
+	}
+}
+
+func TestAsBool(t *testing.T) {
+	for v, expected := range map[interface{}]bool{true: true, int64(1): true, int64(0): false, "1": true, "0": false, nil: false} {
+		if asBool(v) != expected {
+			t.Errorf("Expected %v to be %v", v, expected)
+		}
+	}
+	if !asBool([]byte("1")) || asBool([]byte("0")) {
+		t.Errorf("Expected []byte to be converted")
+	}
+}
+
+func TestPaginatedList(t *testing.T) {
+	r := httptest.NewRequest("GET", "/news?start=40&tag=go", nil)
+	p := NewPaginatedList(orm.NewDataList(orm.NewQuery("Page")), r).SetTotalItems(95)
+
+	if p.CurrentPage() != 5 || p.TotalPages() != 10 || !p.MoreThanOnePage() || p.FirstItem() != 41 || p.LastItem() != 50 {
+		t.Errorf("Unexpected page %d of %d, items %d to %d", p.CurrentPage(), p.TotalPages(), p.FirstItem(), p.LastItem())
+	}
+	if l := p.NextLink(); l != "/news?start=50&tag=go" {
+		t.Errorf("Unexpected next link %s", l)
+	}
+	if l := p.PrevLink(); l != "/news?start=30&tag=go" {
+		t.Errorf("Unexpected previous link %s", l)
+	}
+
+	pageNums := func(pages []*PaginationPage) []int {
+		var nums []int
+		for _, page := range pages {
+			nums = append(nums, page.PageNum)
+		}
+		return nums
+	}
+	if nums := pageNums(p.Pages()); len(nums) != 10 {
+		t.Errorf("Expected 10 pages, got %v", nums)
+	}
+	if nums := pageNums(p.Pages(4)); !reflect.DeepEqual(nums, []int{3, 4, 5, 6}) {
+		t.Errorf("Unexpected limited pages %v", nums)
+	}
+	if nums := pageNums(p.PaginationSummary()); !reflect.DeepEqual(nums, []int{1, 0, 3, 4, 5, 6, 7, 0, 10}) {
+		t.Errorf("Unexpected summary %v", nums)
+	}
+	if current := p.Pages()[4]; !current.CurrentBool || current.Link != "/news?start=40&tag=go" {
+		t.Errorf("Expected page 5 to be current, got %+v", current)
+	}
+
+	p.SetCurrentPage(10)
+	if p.NextLink() != "" || p.LastItem() != 95 {
+		t.Errorf("Expected no next link on the last page, got %s, last item %d", p.NextLink(), p.LastItem())
+	}
+	if nums := pageNums(p.PaginationSummary()); !reflect.DeepEqual(nums, []int{1, 0, 6, 7, 8, 9, 10}) {
+		t.Errorf("Unexpected summary on last page %v", nums)
+	}
+
+	p = NewPaginatedList(orm.NewDataList(orm.NewQuery("Page")), nil).SetTotalItems(5)
+	if p.MoreThanOnePage() || p.PrevLink() != "" || p.FirstLink() != "?start=0" {
+		t.Errorf("Expected a single page without a request")
+	}
+}
+
+// siteTreeDriver is a database/sql driver that records the queries it is given, and returns the
+// pages 5 and 4 for queries on the site tree, so queries can be tested without a database server.
+type siteTreeDriver struct {
+	sync.Mutex
+	queries []string
+}
+
+var siteTreeQueries = &siteTreeDriver{}
+
+func init() {
+	sql.Register("goss_sitetree", siteTreeQueries)
+}
+
+func (d *siteTreeDriver) Open(name string) (driver.Conn, error) { return siteTreeConn{}, nil }
+
+type siteTreeConn struct{}
+
+func (siteTreeConn) Prepare(query string) (driver.Stmt, error) { return siteTreeStmt(query), nil }
+func (siteTreeConn) Close() error                              { return nil }
+func (siteTreeConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+type siteTreeStmt string
+
+func (s siteTreeStmt) Close() error  { return nil }
+func (s siteTreeStmt) NumInput() int { return -1 }
+func (s siteTreeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, driver.ErrSkip
+}
+func (s siteTreeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	siteTreeQueries.Lock()
+	siteTreeQueries.queries = append(siteTreeQueries.queries, string(s))
+	siteTreeQueries.Unlock()
+	return &siteTreeRows{rows: [][]driver.Value{{int64(5), "Page", "History"}, {int64(4), "Page", "Team"}}}, nil
+}
+
+type siteTreeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *siteTreeRows) Columns() []string { return []string{"ID", "ClassName", "Title"} }
+func (r *siteTreeRows) Close() error      { return nil }
+func (r *siteTreeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// siteTreeDatabase configures a database named "sitetree" that uses siteTreeDriver, with metadata
+// for SiteTree and Page that lists no fields.
+func siteTreeDatabase(t *testing.T) *orm.Database {
+	dir := t.TempDir()
+	metadata := `{"Classes": [
+		{"ClassName": "SiteTree", "HasTable": true, "Versioned": true, "Hierarchical": true, "TableName": "SiteTree", "Ancestors": ["SiteTree"], "Descendents": ["Page"]},
+		{"ClassName": "Page", "HasTable": true, "Versioned": true, "TableName": "Page", "Ancestors": ["SiteTree", "Page"]}
+	]}`
+	conf := `{"goss": {
+		"ssroot": "` + dir + `", "theme": "simple",
+		"cache": {"menuTTL": 0, "siteConfigTTL": 0, "siteTreeTTL": 0},
+		"databases": {"sitetree": {"driverName": "goss_sitetree", "dialect": "sqlite", "dataSourceName": "sitetree", "maxIdleConnections": 1, "maxOpenConnections": 1, "metadata": "` + filepath.Join(dir, "metadata.json") + `"}}
+	}}`
+	for name, content := range map[string]string{"metadata.json": metadata, "config.json": conf} {
+		if e := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); e != nil {
+			t.Fatalf("Could not write %s: %s", name, e)
+		}
+	}
+
+	c, e := config.ReadFromFile(filepath.Join(dir, "config.json"))
+	if e != nil {
+		t.Fatalf("Could not read config: %s", e)
+	}
+	if e = goss.SetConfig(c); e != nil {
+		t.Fatalf("Could not set config: %s", e)
+	}
+	return orm.GetDatabase("sitetree")
+}
+
+func TestChildren(t *testing.T) {
+	db := siteTreeDatabase(t)
+	cache.Store("goss.Sitetree."+db.Name, testSiteCache(), time.Minute)
+
+	list, e := children(db, 2, menuChildren)
+	if e != nil {
+		t.Fatalf("Unexpected error %s", e)
+	}
+	items, e := list.Items()
+	if e != nil || len(items) != 2 {
+		t.Fatalf("Expected the children of the page, got %v, %v", items, e)
+	}
+
+	siteTreeQueries.Lock()
+	defer siteTreeQueries.Unlock()
+	if len(siteTreeQueries.queries) != 1 || !strings.HasSuffix(siteTreeQueries.queries[0], `order by "SiteTree"."Sort" asc`) {
+		t.Errorf("Expected the children to be sorted by Sort, got %v", siteTreeQueries.queries)
+	}
+}
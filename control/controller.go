@@ -11,53 +11,101 @@ import (
 	"time"
 )
 
+var errNoDatabase = errors.New("No database is configured")
+
 // Base type for BaseController. Goss doesn't directly create this; it is a base for the application
 // to extend.
 type BaseController struct {
 	request *http.Request
+
+	// the database the controller reads from; nil means the default database.
+	db *orm.Database
+
+	// the page being rendered, for controllers that embed ContentControllerStruct.
+	page interface{}
 }
 
 func (ctl *BaseController) Init(r *http.Request) {
 	ctl.request = r
 }
 
+// Request returns the request the controller is handling, e.g. for NewPaginatedList.
+func (ctl *BaseController) Request() *http.Request {
+	return ctl.request
+}
+
+// SetDatabase binds the controller to a database. SiteTreeHandlerFor does this for the controller of
+// each page it renders.
+func (ctl *BaseController) SetDatabase(db *orm.Database) {
+	ctl.db = db
+}
+
+// Database returns the database the controller reads from, which is nil if it isn't bound to a
+// database and there is no default database.
+func (ctl *BaseController) Database() *orm.Database {
+	if ctl.db == nil {
+		return orm.GetDatabase(orm.DefaultDatabase)
+	}
+	return ctl.db
+}
+
+// Menu returns the pages that show in menus at a level of the site tree, like SilverStripe's
+// ContentController::getMenu. Menu(1) is the top level pages. For higher levels, it is the children of
+// the controller's page's ancestor at the level above, so Menu(2) is the pages of the current section.
+// It returns nil if the page is not that deep. Menus are cached for each parent page.
 func (ctl *BaseController) Menu(level int) (orm.DataList, error) {
-	key := "goss.Menu." + strconv.Itoa(level)
-	result := cache.Get(key)
-	if result != nil {
-		return result.(orm.DataList), nil
+	db := ctl.Database()
+	if db == nil {
+		return nil, errNoDatabase
 	}
 
-	if level == 1 {
-		q := orm.NewQuery("SiteTree").Where("\"SiteTree_Live\".\"ParentID\"=0").Where("\"ShowInMenus\"=1").Sort("\"Sort\" ASC")
-		v, e := q.Run()
-		if e != nil {
-			return nil, e
+	parentID := 0
+	if level != 1 {
+		c := getSiteCache(db)
+		if ctl.page == nil || c == nil {
+			return nil, nil
 		}
-
-		if configuration.cacheMenuTTL > 0 {
-			cache.Store(key, v, time.Duration(configuration.cacheMenuTTL)*time.Second)
+		id, _ := pageIDs(ctl.page)
+		var ok bool
+		if parentID, ok = c.menuParent(id, level); !ok {
+			return nil, nil
 		}
+	}
 
-		return v.(orm.DataList), nil
+	key := "goss.Menu." + db.Name + "." + strconv.Itoa(parentID)
+	result := cache.Get(key)
+	if result != nil {
+		return result.(orm.DataList), nil
 	}
 
-	return nil, nil
-}
+	list, e := children(db, parentID, menuChildren)
+	if e != nil {
+		return nil, e
+	}
+	if _, e = list.Items(); e != nil {
+		return nil, e
+	}
 
-func (ctl *BaseController) Level(level int) orm.DataObject {
-	return nil
+	if configuration.cacheMenuTTL > 0 {
+		cache.Store(key, list, time.Duration(configuration.cacheMenuTTL)*time.Second)
+	}
 
+	return list, nil
 }
 
 // Return the SiteConfig DataObject.
 func (ctl *BaseController) SiteConfig() (obj interface{}, e error) {
-	v := cache.Get("goss.SiteConfig")
+	db := ctl.Database()
+	if db == nil {
+		return nil, errNoDatabase
+	}
+	key := "goss.SiteConfig." + db.Name
+	v := cache.Get(key)
 	if v != nil {
 		return v, nil
 	}
 
-	q := orm.NewQuery("SiteConfig").Limit(0, 1)
+	q := db.NewQuery("SiteConfig").Limit(0, 1)
 	res, e := q.Run()
 	if e != nil {
 		return nil, e
@@ -69,7 +117,7 @@ func (ctl *BaseController) SiteConfig() (obj interface{}, e error) {
 	}
 
 	if configuration.cacheSiteConfigTTL > 0 {
-		cache.Store("goss.SiteConfig", items[0], time.Duration(configuration.cacheSiteConfigTTL)*time.Second)
+		cache.Store(key, items[0], time.Duration(configuration.cacheSiteConfigTTL)*time.Second)
 	}
 
 	return items[0], nil
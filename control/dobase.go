@@ -1,9 +1,10 @@
 package control
 
 import (
+	"github.com/mrmorphic/goss/convert"
 	"github.com/mrmorphic/goss/data"
 	"github.com/mrmorphic/goss/orm"
-	"strconv"
+	"strings"
 )
 
 // A utility type for embedding in models to provide a base set of functionality common to pages.
@@ -14,6 +15,58 @@ type DataObjectBase struct {
 	Title      string
 	MenuTitle  string
 	URLSegment string
+
+	// Whether the page is listed in menus and by Children, and whether it is included in search
+	// results.
+	ShowInMenus  bool
+	ShowInSearch bool
+
+	// the database the object was read from, and the reading mode of the query that read it
+	db   *orm.Database
+	mode orm.ReadingMode
+
+	// relations loaded by DataQuery.With
+	relations map[string]interface{}
+}
+
+// SetDatabase is called by the orm with the database the object is read from, so that Link and
+// relations use the same database.
+func (d *DataObjectBase) SetDatabase(db *orm.Database) {
+	d.db = db
+}
+
+// Database returns the database the object was read from, or the default database.
+func (d *DataObjectBase) Database() *orm.Database {
+	if d.db == nil {
+		return orm.GetDatabase(orm.DefaultDatabase)
+	}
+	return d.db
+}
+
+// SetReadingMode is called by the orm with the reading mode of the query the object is read by, so
+// that relations are read in the same mode.
+func (d *DataObjectBase) SetReadingMode(mode orm.ReadingMode) {
+	d.mode = mode
+}
+
+// ReadingMode returns the reading mode the object was read in.
+func (d *DataObjectBase) ReadingMode() orm.ReadingMode {
+	return d.mode
+}
+
+// SetLoadedRelation is called by the orm with a relation loaded by DataQuery.With, so that accessing
+// it doesn't query again.
+func (d *DataObjectBase) SetLoadedRelation(name string, value interface{}) {
+	if d.relations == nil {
+		d.relations = make(map[string]interface{})
+	}
+	d.relations[name] = value
+}
+
+// LoadedRelation returns a relation stored by SetLoadedRelation.
+func (d *DataObjectBase) LoadedRelation(name string) (interface{}, bool) {
+	v, ok := d.relations[name]
+	return v, ok
 }
 
 // Return MenuTitle, or Title if MenuTitle is blank
@@ -24,27 +77,25 @@ func (d *DataObjectBase) GetMenuTitle() string {
 	return d.MenuTitle
 }
 
-// Generate a BaseHRef-relative link to this page
+// Generate a BaseHRef-relative link to this page. The URL segments of the page's ancestors are taken
+// from the site cache, so this doesn't query the database when the site tree is cached, unless the
+// page's parent isn't in it. Otherwise only the page's ancestors are queried.
 func (d *DataObjectBase) Link(args ...string) string {
-	hier := orm.IsHierarchical(d.ClassName)
+	db := d.Database()
+	hier := db.IsHierarchical(d.ClassName)
 	if !hier {
 		return ""
 	}
 
-	obj := interface{}(d)
 	res := d.URLSegment
-
-	// @todo data.Eval.(int) may fail for a map where the ParentID may have type of string
-	for parentID := data.Eval(obj, "ParentID").(int); parentID > 0; {
-		// @todo don't hardcode "SiteTree", derive the base class using metadata.
-		q := orm.NewQuery("SiteTree").Where("\"SiteTree_Live\".\"ID\"=" + strconv.Itoa(parentID))
-		ds, e := q.Run()
-		if e != nil {
+	if d.ParentID > 0 {
+		segments, ok := ancestorSegments(db, d.ParentID)
+		if !ok {
 			return ""
 		}
-		items, _ := ds.(orm.DataList).Items()
-		obj = items[0]
-		res = data.Eval(obj, "URLSegment").(string) + "/" + res
+		if segments != "" {
+			res = segments + "/" + res
+		}
 	}
 
 	for _, a := range args {
@@ -57,3 +108,40 @@ func (d *DataObjectBase) Link(args ...string) string {
 
 	return res
 }
+
+// Return the URL segments of a page and its ancestors, joined with "/". These come from the site cache
+// if the page is in it, otherwise each ancestor is queried. A partial site cache has already queried
+// the ancestors, so a page it can't find is treated as having no ancestors, as the site cache treats
+// pages whose parent is missing. Returns false if a query fails.
+func ancestorSegments(db *orm.Database, id int) (string, bool) {
+	if c := getSiteCache(db); c != nil {
+		if ancestry := c.ancestry(id); len(ancestry) > 0 || c.partial {
+			var segments []string
+			for _, entry := range ancestry {
+				segments = append(segments, entry.URLSegment)
+			}
+			return strings.Join(segments, "/"), true
+		}
+	}
+
+	res := ""
+	for parentID := id; parentID > 0; {
+		// @todo don't hardcode "SiteTree", derive the base class using metadata.
+		q := db.NewQuery("SiteTree").Where("\"SiteTree\".\"ID\"=?", parentID)
+		ds, e := q.Run()
+		if e != nil {
+			return "", false
+		}
+		items, _ := ds.(orm.DataList).Items()
+		if len(items) == 0 {
+			break
+		}
+		if res == "" {
+			res = data.Eval(items[0], "URLSegment").(string)
+		} else {
+			res = data.Eval(items[0], "URLSegment").(string) + "/" + res
+		}
+		parentID, _ = convert.AsInt(data.Eval(items[0], "ParentID"))
+	}
+	return res, true
+}
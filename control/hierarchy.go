@@ -0,0 +1,203 @@
+package control
+
+import (
+	"errors"
+	"github.com/mrmorphic/goss/convert"
+	"github.com/mrmorphic/goss/data"
+	"github.com/mrmorphic/goss/orm"
+)
+
+// This file provides navigation of the site tree, similar to SilverStripe's Hierarchy extension. The
+// structure of the tree comes from the site cache, so finding children and ancestors doesn't need a
+// query when the site tree is cached; the pages themselves are read from the live site tree, and kept
+// in the site cache once read.
+
+// The maximum number of pages returned by Breadcrumbs, as in SilverStripe.
+const breadcrumbsMaxDepth = 20
+
+var errNoSiteCache = errors.New("The site tree could not be read")
+
+// getPage returns the live page with the given ID, or nil if there is none.
+func getPage(db *orm.Database, id int) (interface{}, error) {
+	c := getSiteCache(db)
+	if c != nil {
+		if page := c.GetCacheByID(id); page != nil {
+			return page, nil
+		}
+	}
+
+	res, e := db.NewQuery("SiteTree").Where("\"SiteTree\".\"ID\"=?", id).Run()
+	if e != nil {
+		return nil, e
+	}
+	items, e := res.(orm.DataList).Items()
+	if e != nil || len(items) == 0 {
+		return nil, e
+	}
+
+	if c != nil {
+		c.CacheDataObject(id, items[0])
+	}
+	return items[0], nil
+}
+
+// children returns a list of the children of a page that the filter selects, in sort order. The list
+// is fetched when its items are needed.
+func children(db *orm.Database, parentID int, which childFilter) (orm.DataList, error) {
+	c := getSiteCache(db)
+	if c == nil {
+		return nil, errNoSiteCache
+	}
+	q := db.NewQuery("SiteTree").Filter(map[string]interface{}{"ID": c.childIDs(parentID, which)}).Sort("Sort")
+	return orm.NewDataList(q), nil
+}
+
+// breadcrumbs returns the pages from the top level down to the page with the given ID. Pages that
+// don't show in menus are left out, except the page itself.
+func breadcrumbs(db *orm.Database, id int) ([]interface{}, error) {
+	c := getSiteCache(db)
+	if c == nil {
+		return nil, errNoSiteCache
+	}
+
+	var ids []int
+	for _, entry := range c.ancestry(id) {
+		if entry.ShowInMenus || entry.ID == id {
+			ids = append(ids, entry.ID)
+		}
+	}
+	if len(ids) > breadcrumbsMaxDepth {
+		ids = ids[len(ids)-breadcrumbsMaxDepth:]
+	}
+	return getPages(db, ids)
+}
+
+// level returns the ancestor of a page at a level of the site tree, where 1 is the top level, or nil
+// if the page isn't that deep. The page itself is returned if it is at that level.
+func level(db *orm.Database, id int, n int) (interface{}, error) {
+	c := getSiteCache(db)
+	if c == nil {
+		return nil, errNoSiteCache
+	}
+
+	ancestry := c.ancestry(id)
+	if n < 1 || n > len(ancestry) {
+		return nil, nil
+	}
+	return getPage(db, ancestry[n-1].ID)
+}
+
+func getPages(db *orm.Database, ids []int) ([]interface{}, error) {
+	result := []interface{}{}
+	for _, id := range ids {
+		page, e := getPage(db, id)
+		if e != nil {
+			return nil, e
+		}
+		if page != nil {
+			result = append(result, page)
+		}
+	}
+	return result, nil
+}
+
+// Return the ID and ParentID of a page.
+func pageIDs(page interface{}) (id int, parentID int) {
+	id, _ = convert.AsInt(data.Eval(page, "ID"))
+	parentID, _ = convert.AsInt(data.Eval(page, "ParentID"))
+	return
+}
+
+// Children returns the children of the page that show in menus, in sort order.
+func (d *DataObjectBase) Children() (orm.DataList, error) {
+	return children(d.Database(), d.ID, menuChildren)
+}
+
+// AllChildren returns all of the children of the page, including those that don't show in menus.
+func (d *DataObjectBase) AllChildren() (orm.DataList, error) {
+	return children(d.Database(), d.ID, allChildren)
+}
+
+// SearchableChildren returns the children of the page that show in search results, in sort order, for
+// listings such as search results and sitemaps.
+func (d *DataObjectBase) SearchableChildren() (orm.DataList, error) {
+	return children(d.Database(), d.ID, searchChildren)
+}
+
+// Parent returns the parent page, or nil for a top level page.
+func (d *DataObjectBase) Parent() (interface{}, error) {
+	if d.ParentID == 0 {
+		return nil, nil
+	}
+	return getPage(d.Database(), d.ParentID)
+}
+
+// Breadcrumbs returns the pages leading to this page from the top level, ending with this page, for
+// use in a loop. Pages that don't show in menus are left out. Unlike SilverStripe, which renders
+// BreadcrumbsTemplate, the template loops over the pages itself:
+//
+//	<% loop $Breadcrumbs %> &raquo; <a href="$Link">$MenuTitle</a><% end_loop %>
+func (d *DataObjectBase) Breadcrumbs() ([]interface{}, error) {
+	return breadcrumbs(d.Database(), d.ID)
+}
+
+// Level returns the ancestor of this page at a level of the site tree, where 1 is the top level.
+func (d *DataObjectBase) Level(n int) (interface{}, error) {
+	return level(d.Database(), d.ID, n)
+}
+
+// Children returns the children of the controller's page that show in menus. This and the other
+// hierarchy methods of BaseController return nil if the controller has no page.
+func (ctl *BaseController) Children() (orm.DataList, error) {
+	if ctl.page == nil {
+		return nil, nil
+	}
+	id, _ := pageIDs(ctl.page)
+	return children(ctl.Database(), id, menuChildren)
+}
+
+// AllChildren returns all of the children of the controller's page.
+func (ctl *BaseController) AllChildren() (orm.DataList, error) {
+	if ctl.page == nil {
+		return nil, nil
+	}
+	id, _ := pageIDs(ctl.page)
+	return children(ctl.Database(), id, allChildren)
+}
+
+// SearchableChildren returns the children of the controller's page that show in search results.
+func (ctl *BaseController) SearchableChildren() (orm.DataList, error) {
+	if ctl.page == nil {
+		return nil, nil
+	}
+	id, _ := pageIDs(ctl.page)
+	return children(ctl.Database(), id, searchChildren)
+}
+
+// Parent returns the parent of the controller's page, or nil for a top level page.
+func (ctl *BaseController) Parent() (interface{}, error) {
+	_, parentID := pageIDs(ctl.page)
+	if parentID == 0 {
+		return nil, nil
+	}
+	return getPage(ctl.Database(), parentID)
+}
+
+// Breadcrumbs returns the pages leading to the controller's page. See DataObjectBase.Breadcrumbs.
+func (ctl *BaseController) Breadcrumbs() ([]interface{}, error) {
+	if ctl.page == nil {
+		return nil, nil
+	}
+	id, _ := pageIDs(ctl.page)
+	return breadcrumbs(ctl.Database(), id)
+}
+
+// Level returns the ancestor of the controller's page at a level of the site tree, where 1 is the top
+// level, e.g. $Level(1).Title is the title of the section the page is in.
+func (ctl *BaseController) Level(n int) (interface{}, error) {
+	if ctl.page == nil {
+		return nil, nil
+	}
+	id, _ := pageIDs(ctl.page)
+	return level(ctl.Database(), id, n)
+}
@@ -0,0 +1,338 @@
+package control
+
+import (
+	"context"
+	"github.com/mrmorphic/goss/orm"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// PaginatedList shows a DataList one page at a time, like SilverStripe's PaginatedList. The start of
+// the current page is read from the request's "start" parameter, and the list's query is limited to
+// that page when it is fetched, so looping over the PaginatedList in a template loops over the items
+// of the current page. Its methods provide the template API for the pagination controls:
+//
+//	<% if $Posts.MoreThanOnePage %>
+//		<% if $Posts.PrevLink %><a href="$Posts.PrevLink">Prev</a><% end_if %>
+//		<% loop $Posts.Pages %>
+//			<% if $CurrentBool %>$PageNum<% else %><a href="$Link">$PageNum</a><% end_if %>
+//		<% end_loop %>
+//		<% if $Posts.NextLink %><a href="$Posts.NextLink">Next</a><% end_if %>
+//	<% end_if %>
+//
+// The total number of items is read with a count query the first time it is needed. The list should
+// not be fetched before it is paginated, and methods such as Sort that are chained on a PaginatedList
+// return the underlying list rather than the PaginatedList.
+type PaginatedList struct {
+	orm.DataList
+
+	request *http.Request
+
+	// name of the request parameter holding the start of the page
+	getVar string
+
+	pageLength int
+	pageStart  int
+
+	// the number of items in the list, or -1 if it hasn't been counted
+	totalItems int
+}
+
+// PaginationPage is a link to a page of a PaginatedList, as returned by Pages and PaginationSummary.
+type PaginationPage struct {
+	// The page number, starting at 1. In PaginationSummary this is 0 for a gap between page numbers.
+	PageNum int
+
+	// The link to the page, which is empty for a gap.
+	Link string
+
+	// Whether this is the current page.
+	CurrentBool bool
+}
+
+// The default number of items on a page, as in SilverStripe.
+const defaultPageLength = 10
+
+// NewPaginatedList returns a PaginatedList of list for a request, with pages of 10 items. The request
+// may be nil, in which case the first page is shown and links are relative query strings.
+func NewPaginatedList(list orm.DataList, r *http.Request) *PaginatedList {
+	p := &PaginatedList{DataList: list, request: r, getVar: "start", pageLength: defaultPageLength, totalItems: -1}
+	p.readPageStart()
+	return p
+}
+
+// Read the start of the page from the request.
+func (p *PaginatedList) readPageStart() {
+	p.pageStart = 0
+	if p.request == nil {
+		return
+	}
+	if start, e := strconv.Atoi(p.request.URL.Query().Get(p.getVar)); e == nil && start > 0 {
+		p.pageStart = start
+	}
+}
+
+// SetPaginationGetVar sets the name of the request parameter holding the start of the page, which is
+// "start" by default. Pages that show more than one PaginatedList need a different one for each.
+func (p *PaginatedList) SetPaginationGetVar(name string) *PaginatedList {
+	p.getVar = name
+	p.readPageStart()
+	return p
+}
+
+// GetPaginationGetVar returns the name of the request parameter holding the start of the page.
+func (p *PaginatedList) GetPaginationGetVar() string {
+	return p.getVar
+}
+
+// SetPageLength sets the number of items on each page. Lengths less than 1 are ignored.
+func (p *PaginatedList) SetPageLength(length int) *PaginatedList {
+	if length > 0 {
+		p.pageLength = length
+	}
+	return p
+}
+
+// GetPageLength returns the number of items on each page.
+func (p *PaginatedList) GetPageLength() int {
+	return p.pageLength
+}
+
+// SetCurrentPage sets the current page, numbered from 1, instead of reading it from the request.
+func (p *PaginatedList) SetCurrentPage(page int) *PaginatedList {
+	if page < 1 {
+		page = 1
+	}
+	p.pageStart = (page - 1) * p.pageLength
+	return p
+}
+
+// GetPageStart returns the offset of the first item of the current page, counting from 0.
+func (p *PaginatedList) GetPageStart() int {
+	return p.pageStart
+}
+
+// SetTotalItems sets the total number of items, for when it is known without a count query.
+func (p *PaginatedList) SetTotalItems(n int) *PaginatedList {
+	p.totalItems = n
+	return p
+}
+
+// TotalItems returns the number of items in the list, across all pages. The other methods treat the
+// list as empty if it can't be counted; the error is returned here.
+func (p *PaginatedList) TotalItems() (int, error) {
+	if p.totalItems >= 0 {
+		return p.totalItems, nil
+	}
+	n, e := p.DataList.Count()
+	if e != nil {
+		return 0, e
+	}
+	p.totalItems = n
+	return n, nil
+}
+
+func (p *PaginatedList) total() int {
+	n, _ := p.TotalItems()
+	return n
+}
+
+// CurrentPage returns the number of the current page, starting at 1.
+func (p *PaginatedList) CurrentPage() int {
+	return p.pageStart/p.pageLength + 1
+}
+
+// TotalPages returns the number of pages.
+func (p *PaginatedList) TotalPages() int {
+	return (p.total() + p.pageLength - 1) / p.pageLength
+}
+
+// MoreThanOnePage returns true if the list has more than one page, so pagination controls are needed.
+func (p *PaginatedList) MoreThanOnePage() bool {
+	return p.TotalPages() > 1
+}
+
+// NotFirstPage returns true if the current page is not the first.
+func (p *PaginatedList) NotFirstPage() bool {
+	return p.CurrentPage() != 1
+}
+
+// NotLastPage returns true if there are pages after the current page.
+func (p *PaginatedList) NotLastPage() bool {
+	return p.CurrentPage() < p.TotalPages()
+}
+
+// FirstItem returns the position of the first item on the current page, counting from 1.
+func (p *PaginatedList) FirstItem() int {
+	return p.pageStart + 1
+}
+
+// LastItem returns the position of the last item on the current page, counting from 1.
+func (p *PaginatedList) LastItem() int {
+	last := p.pageStart + p.pageLength
+	if total := p.total(); last > total {
+		return total
+	}
+	return last
+}
+
+// FirstLink returns the link to the first page.
+func (p *PaginatedList) FirstLink() string {
+	return p.link(0)
+}
+
+// LastLink returns the link to the last page.
+func (p *PaginatedList) LastLink() string {
+	last := p.TotalPages() - 1
+	if last < 0 {
+		last = 0
+	}
+	return p.link(last * p.pageLength)
+}
+
+// NextLink returns the link to the next page, or "" on the last page.
+func (p *PaginatedList) NextLink() string {
+	if !p.NotLastPage() {
+		return ""
+	}
+	return p.link(p.pageStart + p.pageLength)
+}
+
+// PrevLink returns the link to the previous page, or "" on the first page.
+func (p *PaginatedList) PrevLink() string {
+	if !p.NotFirstPage() {
+		return ""
+	}
+	start := p.pageStart - p.pageLength
+	if start < 0 {
+		start = 0
+	}
+	return p.link(start)
+}
+
+// Pages returns a link to each page, for looping over. If max is given, at most that many pages are
+// returned, in a range around the current page.
+func (p *PaginatedList) Pages(max ...int) []*PaginationPage {
+	current := p.CurrentPage()
+	start, end := 0, p.TotalPages()
+	if len(max) > 0 && max[0] > 0 {
+		start = current - max[0]/2 - 1
+		end = start + max[0]
+		if start < 0 {
+			start, end = 0, max[0]
+		}
+		if end > p.TotalPages() {
+			end = p.TotalPages()
+			start = end - max[0]
+			if start < 0 {
+				start = 0
+			}
+		}
+	}
+
+	result := []*PaginationPage{}
+	for i := start; i < end; i++ {
+		result = append(result, p.page(i+1))
+	}
+	return result
+}
+
+// PaginationSummary returns links to the first and last pages and the pages around the current page,
+// with a PaginationPage with PageNum 0 where pages are left out, e.g. 1 … 4 5 6 … 20. context is the
+// number of pages shown around the current page, which is 4 if it isn't given.
+//
+//	<% loop $Posts.PaginationSummary %>
+//		<% if $PageNum %><a href="$Link">$PageNum</a><% else %>&hellip;<% end_if %>
+//	<% end_loop %>
+func (p *PaginatedList) PaginationSummary(context ...int) []*PaginationPage {
+	n := 4
+	if len(context) > 0 {
+		n = context[0]
+	}
+	// make the number even for offset calculations
+	if n%2 != 0 {
+		n--
+	}
+
+	current := p.CurrentPage()
+	total := p.TotalPages()
+
+	// if the first or last page is current, show all the context on one side of it, otherwise half
+	// on each side.
+	offset := n / 2
+	if current == 1 || current == total {
+		offset = n
+	}
+	left := current - offset
+	if left < 1 {
+		left = 1
+	}
+	right := current + offset
+	if right > total {
+		right = total
+	}
+	if left+n > total {
+		left = total - n
+	}
+
+	result := []*PaginationPage{}
+	for num := 1; num <= total; num++ {
+		gap := num != 1 && num != total && (num == left-1 || num == right+1)
+		switch {
+		case gap:
+			result = append(result, &PaginationPage{})
+		case num == 1 || num == total || (num >= current-offset && num <= current+offset):
+			result = append(result, p.page(num))
+		}
+	}
+	return result
+}
+
+// Return the PaginationPage for a page number.
+func (p *PaginatedList) page(num int) *PaginationPage {
+	return &PaginationPage{PageNum: num, Link: p.link((num - 1) * p.pageLength), CurrentBool: num == p.CurrentPage()}
+}
+
+// Return the URL of the request with the pagination parameter set to start.
+// Without a request, the link is just the query string.
+func (p *PaginatedList) link(start int) string {
+	if p.request == nil {
+		return "?" + url.Values{p.getVar: {strconv.Itoa(start)}}.Encode()
+	}
+	u := *p.request.URL
+	q := u.Query()
+	q.Set(p.getVar, strconv.Itoa(start))
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// Limit the list to the current page.
+func (p *PaginatedList) limited() orm.DataList {
+	return p.DataList.Limit(p.pageStart, p.pageLength).(orm.DataList)
+}
+
+// Run fetches the items of the current page.
+func (p *PaginatedList) Run() (interface{}, error) {
+	return p.limited().Run()
+}
+
+// RunContext fetches the items of the current page, cancelling the query if ctx is done.
+func (p *PaginatedList) RunContext(ctx context.Context) (interface{}, error) {
+	return p.limited().RunContext(ctx)
+}
+
+// Each calls fn with each item of the current page.
+func (p *PaginatedList) Each(fn func(interface{}) error) error {
+	return p.limited().Each(fn)
+}
+
+// EachContext calls fn with each item of the current page. Template loops use this.
+func (p *PaginatedList) EachContext(ctx context.Context, fn func(interface{}) error) error {
+	return p.limited().EachContext(ctx, fn)
+}
+
+// Items returns the items of the current page.
+func (p *PaginatedList) Items() ([]interface{}, error) {
+	return p.limited().Items()
+}
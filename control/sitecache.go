@@ -2,11 +2,12 @@ package control
 
 import (
 	"database/sql"
-	"fmt"
 	"github.com/mrmorphic/goss/cache"
 	"github.com/mrmorphic/goss/data"
 	"github.com/mrmorphic/goss/orm"
 	"net/http"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -20,34 +21,50 @@ type siteCacheEntry struct {
 	Title        string
 	MenuTitle    string
 	URLSegment   string
+	ShowInMenus  bool
+	ShowInSearch bool
+	Sort         int
 	RelativePath string
 }
 
 type SiteCache struct {
+	// the database the site tree is read from
+	db *orm.Database
+
 	// raw list of site tree records
 	raw []*siteCacheEntry
 
 	// a map of relative site paths to siteCacheEntry objects
 	paths map[string]*siteCacheEntry
 
-	// a map of object IDs to data objects.
-	objByID map[int]interface{}
+	// entries by ID, and the entries of the children of each ID in sort order.
+	byID     map[int]*siteCacheEntry
+	children map[int][]*siteCacheEntry
+
+	// a map of object IDs to data objects. This is filled in as pages are read, so is locked.
+	objByID     map[int]interface{}
+	objByIDLock sync.RWMutex
+
+	// If true, the cache wasn't primed with the whole site tree. Entries and lists of children are
+	// read from the database as they are needed, and don't include paths.
+	partial bool
 }
 
+// The columns of the live site tree read into siteCacheEntry.
+const siteCacheColumns = `"ID","ClassName","ParentID","Title","MenuTitle","URLSegment","ShowInMenus","ShowInSearch","Sort"`
+
 // primeSiteCache is responsible for re-computing the data structures in the cache. It does this
 // by requerying the database, rebuilding the structure, and finally replacing the data structures
 // atomically. In this way, a request being processed will either get the old version or the new
 // version, but whichever version it's using won't be replaced mid-request.
-func primeSiteCache() (*SiteCache, error) {
-	r, e := orm.Query(`select "ID","ClassName","ParentID","Title","MenuTitle","URLSegment" from "SiteTree_Live"`)
-	defer r.Close()
-
+func primeSiteCache(db *orm.Database) (*SiteCache, error) {
+	r, e := db.Query(`select ` + siteCacheColumns + ` from "` + db.TableForMode("SiteTree", orm.Live) + `"`)
 	if e != nil {
-		fmt.Printf("ERROR EXECUTING SQL: %s\n", e)
 		return nil, e
 	}
+	defer r.Close()
 
-	newCache := newSiteCache()
+	newCache := newSiteCache(db)
 
 	for r.Next() {
 		e := newCache.ReadRow(r)
@@ -57,79 +74,127 @@ func primeSiteCache() (*SiteCache, error) {
 	}
 
 	newCache.derivePaths()
-
-	fmt.Printf("primeSiteCache: %s\n", newCache)
+	newCache.deriveChildren()
 
 	return newCache, nil
 }
 
-func newSiteCache() *SiteCache {
-	return &SiteCache{raw: []*siteCacheEntry{}, paths: map[string]*siteCacheEntry{}, objByID: map[int]interface{}{}}
+func newSiteCache(db *orm.Database) *SiteCache {
+	return &SiteCache{db: db, raw: []*siteCacheEntry{}, paths: map[string]*siteCacheEntry{}, byID: map[int]*siteCacheEntry{},
+		children: map[int][]*siteCacheEntry{}, objByID: map[int]interface{}{}}
 }
 
-func getSiteCache() *SiteCache {
-	key := "goss.Sitetree"
+// getSiteCache returns the site cache for a database. Each database has its own cache. If the site
+// tree isn't cached, because goss.cache.siteTreeTTL is 0, priming the cache for each use would read
+// the whole site tree every time, so a partial cache is returned instead, which reads only the entries
+// that are used. It returns nil if there is no database.
+func getSiteCache(db *orm.Database) *SiteCache {
+	if db == nil {
+		return nil
+	}
+	key := "goss.Sitetree." + db.Name
 	result := cache.Get(key)
 	if result != nil {
 		return result.(*SiteCache)
 	}
 
-	c, _ := primeSiteCache()
+	if configuration.cacheSiteTreeNavTTL <= 0 {
+		c := newSiteCache(db)
+		c.partial = true
+		return c
+	}
 
-	if configuration.cacheSiteTreeNavTTL > 0 {
-		cache.Store(key, c, time.Duration(configuration.cacheSiteTreeNavTTL)*time.Second)
+	c, e := primeSiteCache(db)
+	if e != nil {
+		return nil
 	}
+	cache.Store(key, c, time.Duration(configuration.cacheSiteTreeNavTTL)*time.Second)
 
 	return c
 }
 
+// Return the entry for a page, or nil if there is none. A partial cache reads the entry from the
+// database if it hasn't been read already.
+func (c *SiteCache) entry(id int) *siteCacheEntry {
+	if entry := c.byID[id]; entry != nil || !c.partial || id == 0 {
+		return entry
+	}
+	c.readEntries(`"ID"=?`, id)
+	return c.byID[id]
+}
+
+// Return the entries of the children of a page in sort order. A partial cache reads them from the
+// database the first time they are needed.
+func (c *SiteCache) childEntries(parentID int) []*siteCacheEntry {
+	children, ok := c.children[parentID]
+	if ok || !c.partial {
+		return children
+	}
+
+	children = c.readEntries(`"ParentID"=? order by "Sort"`, parentID)
+	if children != nil {
+		c.children[parentID] = children
+	}
+	return children
+}
+
+// Read the live site tree entries selected by a where clause into a partial cache, returning them, or
+// nil if they can't be read.
+func (c *SiteCache) readEntries(where string, args ...interface{}) []*siteCacheEntry {
+	r, e := c.db.Query(`select `+siteCacheColumns+` from "`+c.db.TableForMode("SiteTree", orm.Live)+`" where `+where, args...)
+	if e != nil {
+		return nil
+	}
+	defer r.Close()
+
+	entries := []*siteCacheEntry{}
+	for r.Next() {
+		if e = c.ReadRow(r); e != nil {
+			return nil
+		}
+		entries = append(entries, c.raw[len(c.raw)-1])
+	}
+	if r.Err() != nil {
+		return nil
+	}
+	return entries
+}
+
 // After computing the cache, if content controller subsequently loads a page for rendering against,
 // it can add this to the cache. It will be cleared when the site tree cache is next cleared.
 func (c *SiteCache) CacheDataObject(id int, object interface{}) {
+	c.objByIDLock.Lock()
+	defer c.objByIDLock.Unlock()
 	c.objByID[id] = object
 }
 
 func (c *SiteCache) GetCacheByID(id int) interface{} {
+	c.objByIDLock.RLock()
+	defer c.objByIDLock.RUnlock()
 	return c.objByID[id]
 }
 
+// ReadRow reads the current row of r into a new entry in the cache. Columns are converted using the
+// types of SiteTree's fields in the metadata.
 func (c *SiteCache) ReadRow(r *sql.Rows) error {
-	cols, e := r.Columns()
-	colCount := len(cols)
-
-	var field []interface{}
-	for i := 0; i < colCount; i++ {
-		switch {
-		case cols[i][:2] == "b:":
-			field = append(field, new(sql.NullBool))
-		case cols[i][:2] == "f:":
-			field = append(field, new(sql.NullFloat64))
-		case cols[i][:2] == "i:":
-			field = append(field, new(sql.NullInt64))
-		case cols[i][:2] == "s:":
-			field = append(field, new(sql.NullString))
-		case cols[i][:2] == "t:":
-			field = append(field, new(time.Time))
-		default:
-			field = append(field, new(sql.NullString))
-		}
-	}
-
-	e = r.Scan(field...)
-
+	row, e := c.db.ScanRow(r, "SiteTree")
 	if e != nil {
-		fmt.Printf("got an error though: %s\n", e)
 		return e
 	}
 
 	m := &siteCacheEntry{}
-
-	for i, c := range cols {
-		v := flatten(field[i])
-		data.Set(m, c, v)
+	for col, v := range row {
+		switch col {
+		case "ShowInMenus", "ShowInSearch":
+			// these are only converted to bool if the metadata has the field types.
+			data.Set(m, col, asBool(v))
+		default:
+			data.Set(m, col, v)
+		}
 	}
 
 	c.raw = append(c.raw, m)
+	c.byID[m.ID] = m
 
 	return nil
 }
@@ -170,27 +235,90 @@ func (c *SiteCache) derivePathEntry(entry *siteCacheEntry) {
 }
 
 func (c *SiteCache) findRawByID(id int) *siteCacheEntry {
+	return c.byID[id]
+}
+
+// Given the entries in c.raw, derive the lists of children of each entry, ordered by Sort.
+func (c *SiteCache) deriveChildren() {
 	for _, entry := range c.raw {
-		if entry.ID == id {
-			return entry
+		c.children[entry.ParentID] = append(c.children[entry.ParentID], entry)
+	}
+	for _, children := range c.children {
+		sort.Stable(bySort(children))
+	}
+}
+
+type bySort []*siteCacheEntry
+
+func (s bySort) Len() int           { return len(s) }
+func (s bySort) Less(i, j int) bool { return s[i].Sort < s[j].Sort }
+func (s bySort) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// childFilter selects which of the children of a page are listed.
+type childFilter int
+
+const (
+	// pages that show in menus
+	menuChildren childFilter = iota
+
+	// all pages
+	allChildren
+
+	// pages that show in search results
+	searchChildren
+)
+
+// Return the IDs of the children of a page that the filter selects, in sort order.
+func (c *SiteCache) childIDs(parentID int, which childFilter) []int {
+	ids := []int{}
+	for _, entry := range c.childEntries(parentID) {
+		if which == allChildren || (which == menuChildren && entry.ShowInMenus) || (which == searchChildren && entry.ShowInSearch) {
+			ids = append(ids, entry.ID)
 		}
 	}
-	return nil
+	return ids
 }
 
-func flatten(sqlField interface{}) interface{} {
-	switch v := sqlField.(type) {
-	case *sql.NullBool:
-		return v.Bool
-	case *sql.NullFloat64:
-		return v.Float64
-	case *sql.NullInt64:
-		return v.Int64
-	case *sql.NullString:
-		return v.String
+// Return the entries of a page and its ancestors, top level page first. The result is empty if the
+// page is not in the cache.
+func (c *SiteCache) ancestry(id int) []*siteCacheEntry {
+	var result []*siteCacheEntry
+	seen := map[int]bool{}
+	for entry := c.entry(id); entry != nil && !seen[entry.ID]; entry = c.entry(entry.ParentID) {
+		seen[entry.ID] = true
+		result = append([]*siteCacheEntry{entry}, result...)
 	}
+	return result
+}
 
-	return sqlField
+// Return the ID of the page whose children are the menu at a level for the page with the given ID, and
+// false if the page isn't deep enough to have a menu at that level.
+func (c *SiteCache) menuParent(id int, level int) (int, bool) {
+	if level == 1 {
+		return 0, true
+	}
+	ancestry := c.ancestry(id)
+	if level < 1 || level-1 > len(ancestry) {
+		return 0, false
+	}
+	return ancestry[level-2].ID, true
+}
+
+// Interpret a column value as a boolean, whether the driver gives it as a bool, number or text.
+func asBool(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case int64:
+		return b != 0
+	case int:
+		return b != 0
+	case []byte:
+		return len(b) > 0 && string(b) != "0"
+	case string:
+		return b != "" && b != "0"
+	}
+	return false
 }
 
 // Given a request, find the site tree entry by path and return the ID
@@ -3,23 +3,51 @@ package convert
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"reflect"
 	"strconv"
+	"time"
 )
 
+// The format SilverStripe uses for SS_Datetime fields, which times are formatted with.
+const datetimeFormat = "2006-01-02 15:04:05"
+
+// AsString returns the text of a value, as SilverStripe would show it. Numbers are written in
+// decimal, booleans as "1" or "0" as they're stored, times in SilverStripe's datetime format, and nil
+// as "".
 func AsString(v interface{}) string {
-	t := reflect.TypeOf(v)
-	switch t.String() {
-	case "*sql.NullString":
-		s := v.(*sql.NullString)
+	switch s := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	case *sql.NullString:
 		return s.String
-	case "string":
-		return v.(string)
+	case bool:
+		if s {
+			return "1"
+		}
+		return "0"
+	case int:
+		return strconv.Itoa(s)
+	case int64:
+		return strconv.FormatInt(s, 10)
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(s), 'f', -1, 32)
+	case time.Time:
+		return s.Format(datetimeFormat)
 	}
-	return "don't know this type: " + t.String()
+	return fmt.Sprint(v)
 }
 
 func AsInt(v interface{}) (int, error) {
+	if v == nil {
+		return 0, nil
+	}
 	t := reflect.TypeOf(v)
 	switch t.String() {
 	case "*sql.NullInt64":
@@ -29,6 +57,12 @@ func AsInt(v interface{}) (int, error) {
 		// observed but not expected
 		v := v.(*sql.NullString)
 		return strconv.Atoi(v.String)
+	case "int":
+		return v.(int), nil
+	case "int64":
+		return int(v.(int64)), nil
+	case "string":
+		return strconv.Atoi(v.(string))
 	}
 	return 0, errors.New("AsInt doesn't understand type " + t.String())
 
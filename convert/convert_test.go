@@ -1 +1,30 @@
 package convert
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAsString(t *testing.T) {
+	tests := map[interface{}]string{
+		"text":       "text",
+		5:            "5",
+		int64(-7):    "-7",
+		true:         "1",
+		false:        "0",
+		1.5:          "1.5",
+		float64(100): "100",
+		time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC): "2013-06-01 12:00:00",
+	}
+	for v, expected := range tests {
+		if s := AsString(v); s != expected {
+			t.Errorf("Expected %v to be %q, got %q", v, expected, s)
+		}
+	}
+	if s := AsString(nil); s != "" {
+		t.Errorf("Expected nil to be empty, got %q", s)
+	}
+	if s := AsString([]byte("raw")); s != "raw" {
+		t.Errorf("Expected bytes as text, got %q", s)
+	}
+}
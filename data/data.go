@@ -8,6 +8,21 @@ import (
 	"strconv"
 )
 
+// Resolver is a function that can provide a value for a name that a context doesn't define itself,
+// such as a relation of a DataObject. The second return value is false if the resolver doesn't
+// know the name in that context.
+type Resolver func(context interface{}, name string, args ...interface{}) (interface{}, bool)
+
+// resolvers are tried in order of registration when a name can't be found in a context, before
+// trying Fallback.
+var resolvers []Resolver
+
+// RegisterResolver adds a resolver that DefaultLocater will use for names that aren't defined by a
+// context. This lets packages such as orm add behaviour to plain maps and structs.
+func RegisterResolver(r Resolver) {
+	resolvers = append(resolvers, r)
+}
+
 func Eval(context interface{}, name string, args ...interface{}) interface{} {
 	return NewDefaultLocater(context).Get(name, args...)
 }
@@ -32,7 +47,7 @@ func Set(context interface{}, name string, value interface{}) {
 			t := f.Type()
 
 			// ensure that the type is assignable to the field
-			vi := convertToType(v.Interface(), t)
+			vi := ConvertToType(v.Interface(), t)
 
 			// now set it
 			f.Set(reflect.ValueOf(vi))
@@ -90,14 +105,23 @@ func (d *DefaultLocater) Get(name string, args ...interface{}) interface{} {
 				value = ctx.FieldByName(name)
 			}
 		}
+	case ctx.Kind() == reflect.Slice:
+		// a slice has no properties, but its type may have methods, e.g. orm.GroupedList.GroupedBy
+		value = ctxOrig.MethodByName(name)
 	}
 
 	// Now we have the value, work out what to do with it. There are two special cases; value couldn't
-	// be determined so try _fallback; the value's kind is a function, so call it with args
+	// be determined so try resolvers and then _fallback; the value's kind is a function, so call it with args
 	switch {
 	case IsZeroOfUnderlyingType(value):
-		// see if there is a _fallback
 		if name != "Fallback" {
+			for _, r := range resolvers {
+				if v, ok := r(d.context, name, args...); ok {
+					return v
+				}
+			}
+
+			// see if there is a _fallback
 			fallback := d.Get("Fallback")
 			// fmt.Printf("fallback is %s\n", fallback)
 			if fallback != nil {
@@ -130,14 +154,18 @@ func getConvertedParams(method reflect.Value, args []interface{}) []reflect.Valu
 		// get the param definition, if we haven't exhausted them already
 		var param reflect.Type
 		hasParam := false
-		if paramIndex < nParams {
+		if methodType.IsVariadic() && paramIndex >= nParams-1 {
+			// the remaining args are elements of the variadic parameter
+			param = methodType.In(nParams - 1).Elem()
+			hasParam = true
+		} else if paramIndex < nParams {
 			param = methodType.In(paramIndex)
 			hasParam = true
 		}
 
 		// determine if conversion is required
 		if hasParam {
-			x = convertToType(x, param)
+			x = ConvertToType(x, param)
 		}
 
 		// finally add the value to the list of parameters
@@ -148,7 +176,9 @@ func getConvertedParams(method reflect.Value, args []interface{}) []reflect.Valu
 	return a
 }
 
-func convertToType(x interface{}, t reflect.Type) interface{} {
+// ConvertToType converts x to type t where the runtime can, or where PHP would, such as a string to an
+// int. If x can't be converted it is returned unchanged.
+func ConvertToType(x interface{}, t reflect.Type) interface{} {
 	// fmt.Printf("\nconvertTo: %s to %s\n", x, t.Name())
 	argType := reflect.TypeOf(x)
 	if argType.AssignableTo(t) {
@@ -156,11 +186,19 @@ func convertToType(x interface{}, t reflect.Type) interface{} {
 		return x
 	}
 
+	// the runtime converts integers to strings as a character, so numbers are formatted instead.
+	if t.Kind() == reflect.String && argType.Kind() != reflect.String {
+		switch argType.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64, reflect.Bool:
+			return reflect.ValueOf(convert.AsString(x)).Convert(t).Interface()
+		}
+	}
+
 	if argType.ConvertibleTo(t) {
 		// if convertible by runtime, convert it
-		v := reflect.ValueOf(x)
-		v.Convert(t)
-		return v.Interface()
+		return reflect.ValueOf(x).Convert(t).Interface()
 	}
 
 	// if x is a string and t is an int, convert
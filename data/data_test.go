@@ -2,6 +2,7 @@ package data
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -90,3 +91,86 @@ func TestControllerStructure(t *testing.T) {
 		}
 	}
 }
+
+// Test that a registered resolver provides names that the context doesn't have, but doesn't
+// override names it does have.
+func TestResolver(t *testing.T) {
+	RegisterResolver(func(context interface{}, name string, args ...interface{}) (interface{}, bool) {
+		if name == "Resolved" {
+			return "resolved value", true
+		}
+		return nil, false
+	})
+
+	context := map[string]interface{}{"prop1": "value1"}
+
+	if v := Eval(context, "prop1"); v != "value1" {
+		t.Errorf("Expected 'value1', got %v", v)
+	}
+	if v := Eval(context, "Resolved"); v != "resolved value" {
+		t.Errorf("Expected 'resolved value', got %v", v)
+	}
+	if v := Eval(context, "Unknown"); v != nil {
+		t.Errorf("Expected nil, got %v", v)
+	}
+}
+
+type variadic struct{}
+
+func (v *variadic) Sum(n ...int) int {
+	total := 0
+	for _, i := range n {
+		total += i
+	}
+	return total
+}
+
+// Test that template arguments are converted to the element type of a variadic parameter, and that
+// the parameter can be left out.
+func TestVariadicMethod(t *testing.T) {
+	if v := Eval(&variadic{}, "Sum", "2", 3); v != 5 {
+		t.Errorf("Expected 5, got %v", v)
+	}
+	if v := Eval(&variadic{}, "Sum"); v != 0 {
+		t.Errorf("Expected 0, got %v", v)
+	}
+}
+
+type names []string
+
+func (n names) Count() int {
+	return len(n)
+}
+
+// Test that methods of slice types can be called.
+func TestSliceMethod(t *testing.T) {
+	if v := Eval(names{"a", "b"}, "Count"); v != 2 {
+		t.Errorf("Expected 2, got %v", v)
+	}
+	if v := Eval(names{"a", "b"}, "Unknown"); v != nil {
+		t.Errorf("Expected nil, got %v", v)
+	}
+}
+
+type echo struct {
+	Code string
+}
+
+func (e *echo) Echo(s string) string {
+	return s
+}
+
+// Test that numbers are converted to strings as their digits, not as a character.
+func TestConvertNumberToString(t *testing.T) {
+	if v := ConvertToType(65, reflect.TypeOf("")); v != "65" {
+		t.Errorf("Expected \"65\", got %q", v)
+	}
+	if v := Eval(&echo{}, "Echo", 66); v != "66" {
+		t.Errorf("Expected \"66\", got %v", v)
+	}
+	e := &echo{}
+	Set(e, "Code", 65)
+	if e.Code != "65" {
+		t.Errorf("Expected \"65\", got %q", e.Code)
+	}
+}
@@ -0,0 +1,125 @@
+package orm
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Aggregate functions on DataQuerySQL. These use the same tables and conditions as fetching the objects
+// of the query, but return a single value from one select. Sort and Limit are ignored, so Count gives
+// the total number of objects regardless of paging.
+
+// Count returns the number of objects the query matches.
+func (q *DataQuerySQL) Count() (int, error) {
+	var n int
+	e := q.aggregate("count(*)", &n)
+	return n, e
+}
+
+// Exists returns true if the query matches at least one object.
+func (q *DataQuerySQL) Exists() (bool, error) {
+	sql, args, e := q.aggregateSQL("1")
+	if e != nil {
+		return false, e
+	}
+
+	sql += " " + q.database().Dialect().Limit(0, 1)
+	start := time.Now()
+	rows, e := q.query(q.context(), sql, args...)
+	if e != nil {
+		q.database().observe(sql, args, start, 0, e)
+		return false, e
+	}
+	defer rows.Close()
+
+	exists := rows.Next()
+	n := 0
+	if exists {
+		n = 1
+	}
+	q.database().observe(sql, args, start, n, rows.Err())
+	return exists, rows.Err()
+}
+
+// Max returns the largest value of a field, or nil if there are no objects.
+func (q *DataQuerySQL) Max(field string) (interface{}, error) {
+	return q.aggregateField("max", field)
+}
+
+// Min returns the smallest value of a field, or nil if there are no objects.
+func (q *DataQuerySQL) Min(field string) (interface{}, error) {
+	return q.aggregateField("min", field)
+}
+
+// Sum returns the total of a numeric field, or 0 if there are no objects.
+func (q *DataQuerySQL) Sum(field string) (float64, error) {
+	var v sql.NullFloat64
+	e := q.aggregateColumn("sum", field, &v)
+	return v.Float64, e
+}
+
+// Avg returns the average of a numeric field, or 0 if there are no objects.
+func (q *DataQuerySQL) Avg(field string) (float64, error) {
+	var v sql.NullFloat64
+	e := q.aggregateColumn("avg", field, &v)
+	return v.Float64, e
+}
+
+// Apply an aggregate function to a field, returning the value as the driver gives it, except that text
+// is returned as a string.
+func (q *DataQuerySQL) aggregateField(fn string, field string) (interface{}, error) {
+	var v interface{}
+	e := q.aggregateColumn(fn, field, &v)
+	if b, ok := v.([]byte); ok {
+		return string(b), e
+	}
+	return v, e
+}
+
+// Apply an aggregate function to a field, which must be in the metadata or an extra field of a join.
+func (q *DataQuerySQL) aggregateColumn(fn string, field string, dest interface{}) error {
+	ci, e := q.classInfo()
+	if e != nil {
+		return e
+	}
+	column, e := q.fieldColumn(ci, field)
+	if e != nil {
+		return e
+	}
+	return q.aggregate(fn+"("+column+")", dest)
+}
+
+// Generate the SQL selecting only expr from the query's tables, with its arguments.
+func (q *DataQuerySQL) aggregateSQL(expr string) (string, []interface{}, error) {
+	ci, e := q.classInfo()
+	if e != nil {
+		return "", nil, e
+	}
+
+	fromWhere, args := q.fromWhere(ci)
+	return "select " + expr + " " + fromWhere, args, nil
+}
+
+// Execute the query selecting only expr, and scan the single result into dest.
+func (q *DataQuerySQL) aggregate(expr string, dest interface{}) error {
+	sql, args, e := q.aggregateSQL(expr)
+	if e != nil {
+		return e
+	}
+
+	start := time.Now()
+	rows, e := q.query(q.context(), sql, args...)
+	if e != nil {
+		q.database().observe(sql, args, start, 0, e)
+		return e
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		q.database().observe(sql, args, start, 0, rows.Err())
+		return rows.Err()
+	}
+	e = rows.Scan(dest)
+	q.database().observe(sql, args, start, 1, e)
+	return e
+}
@@ -0,0 +1,226 @@
+package orm
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file converts column values read from the database into Go values, according to the
+// SilverStripe type of the field in the metadata:
+//  * Int, ForeignKey, PrimaryKey and Year are int
+//  * Boolean is bool
+//  * Decimal, Currency, Float, Double and Percentage are float64
+//  * Date, SS_Datetime and Datetime are time.Time
+//  * everything else, including Varchar, Text, HTMLText, Enum and fields not in the metadata, is string
+// As in SilverStripe, null is read as the zero value of the type.
+
+// Types of the fields that every class' base table has, which aren't listed in the metadata.
+var systemFieldTypes = map[string]string{
+	"ID":         "Int",
+	"ClassName":  "Enum",
+	"Created":    "SS_Datetime",
+	"LastEdited": "SS_Datetime",
+	"Version":    "Int",
+	"RecordID":   "Int",
+}
+
+// Layouts that date and time columns are parsed with. MySQL returns these as text unless the
+// connection is set up to parse them.
+var dateLayouts = []string{datetimeFormat, "2006-01-02", time.RFC3339Nano}
+
+// Work out the SilverStripe types of the columns read for the class, which are the fields of its
+// own tables and those of its descendents. This must be called after the tables have been worked out.
+func (ci *ClassInfo) precacheColumnTypes() {
+	ci.columnTypes = make(map[string]string)
+	for name, t := range systemFieldTypes {
+		ci.columnTypes[name] = t
+	}
+	for _, tables := range [][]*ClassInfo{ci.tables, ci.descendentTables} {
+		for _, t := range tables {
+			for _, f := range t.Fields {
+				ci.columnTypes[f.Name] = f.SSType
+			}
+		}
+	}
+}
+
+// Read the current row into a slice of values as the driver returns them.
+func scanRow(r *sql.Rows) ([]string, []interface{}, error) {
+	cols, e := r.Columns()
+	if e != nil {
+		return nil, nil, e
+	}
+
+	raw := make([]interface{}, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range raw {
+		dest[i] = &raw[i]
+	}
+	if e = r.Scan(dest...); e != nil {
+		return nil, nil, e
+	}
+	return cols, raw, nil
+}
+
+// ScanRow reads the current row of r into a map of column names to values, converted to Go types
+// using the types of className's fields in the default database's metadata. It is for reading rows
+// from SQL that is not generated by a DataQuery.
+func ScanRow(r *sql.Rows, className string) (map[string]interface{}, error) {
+	return defaultDatabase().ScanRow(r, className)
+}
+
+// ScanRow reads the current row of r into a map of column names to values, converted to Go types
+// using the types of className's fields in this database's metadata.
+func (d *Database) ScanRow(r *sql.Rows, className string) (map[string]interface{}, error) {
+	ci := d.Metadata().GetClass(className)
+
+	cols, raw, e := scanRow(r)
+	if e != nil {
+		return nil, e
+	}
+
+	result := make(map[string]interface{})
+	for i, c := range cols {
+		v, e := convertColumn(ci.columnType(c), raw[i])
+		if e != nil {
+			return nil, e
+		}
+		result[c] = v
+	}
+	return result, nil
+}
+
+// Return the SilverStripe type of a column of the class, or "" if it's not known.
+func (ci *ClassInfo) columnType(column string) string {
+	if ci == nil {
+		return systemFieldTypes[column]
+	}
+	return ci.columnTypes[column]
+}
+
+// Convert a value read from the database to the Go type for a SilverStripe field type. Parameters
+// of the type, as in "Varchar(255)" or "Enum('A,B')", are ignored.
+func convertColumn(ssType string, raw interface{}) (interface{}, error) {
+	if i := strings.Index(ssType, "("); i >= 0 {
+		ssType = ssType[:i]
+	}
+
+	var v interface{}
+	var e error
+	switch ssType {
+	case "Int", "ForeignKey", "PrimaryKey", "Year":
+		v, e = columnInt(raw)
+	case "Boolean":
+		v, e = columnBool(raw)
+	case "Decimal", "Currency", "Float", "Double", "Percentage":
+		v, e = columnFloat(raw)
+	case "Date", "SS_Datetime", "Datetime":
+		v, e = columnTime(raw)
+	default:
+		v = columnString(raw)
+	}
+
+	if e != nil {
+		return nil, errors.New("Could not read " + ssType + " value: " + e.Error())
+	}
+	return v, nil
+}
+
+func columnString(raw interface{}) string {
+	switch v := raw.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case time.Time:
+		return v.Format(datetimeFormat)
+	}
+	return fmt.Sprintf("%v", raw)
+}
+
+func columnInt(raw interface{}) (int, error) {
+	switch v := raw.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		return int(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	s := columnString(raw)
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func columnBool(raw interface{}) (bool, error) {
+	switch v := raw.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	}
+
+	s := columnString(raw)
+	if s == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+func columnFloat(raw interface{}) (float64, error) {
+	switch v := raw.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	}
+
+	s := columnString(raw)
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// Dates are read in local time, as SilverStripe writes them. MySQL's zero dates are read as the zero
+// time.
+func columnTime(raw interface{}) (time.Time, error) {
+	switch v := raw.(type) {
+	case nil:
+		return time.Time{}, nil
+	case time.Time:
+		return v, nil
+	}
+
+	s := columnString(raw)
+	if s == "" || strings.HasPrefix(s, "0000-00-00") {
+		return time.Time{}, nil
+	}
+
+	var e error
+	for _, layout := range dateLayouts {
+		var t time.Time
+		if t, e = time.ParseInLocation(layout, s, time.Local); e == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, e
+}
@@ -1,80 +1,227 @@
 package orm
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/mrmorphic/goss"
+	"log/slog"
+	"sort"
+	"time"
 )
 
 func init() {
-	fns := []func(goss.ConfigProvider) error{setupDB, setupMetadata}
+	fns := []func(goss.ConfigProvider) error{setupQueryLog, setupDatabases}
 	goss.RegisterInit(fns)
 }
 
+// setupDatabases opens each configured database and loads its metadata. Named databases are
+// configured under goss.databases.<name>. The default database can also be configured under
+// goss.database, with its metadata properties directly under goss:
+//
+//	"database": {"driverName": "mysql", ...},
+//	"metadata": "/path/to/metadata.json",
+//	"databases": {
+//		"other": {"driverName": "mysql", ..., "metadata": "/path/to/other.json"}
+//	}
+func setupDatabases(config goss.ConfigProvider) error {
+	var names []string
+	if named, ok := config.Get("goss.databases").(map[string]interface{}); ok {
+		for name := range named {
+			names = append(names, name)
+		}
+	}
+	if config.Get("goss.database.driverName") != nil && config.Get("goss.databases."+DefaultDatabase) == nil {
+		names = append(names, DefaultDatabase)
+	}
+	if len(names) == 0 {
+		return errors.New("goss requires config property goss.database.driverName to be set.")
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		d := &Database{Name: name}
+		get := databaseConfig(config, name)
+		if e := d.setupDB(get); e != nil {
+			return e
+		}
+		if e := d.setupMetadata(get); e != nil {
+			return e
+		}
+		registerDatabase(d)
+	}
+	return nil
+}
+
+// databaseConfig returns a function that gets a configuration property of a database, given the
+// property name within the database's configuration. Properties of the default database that aren't
+// under goss.databases.default are looked for under goss.database, then goss.
+func databaseConfig(config goss.ConfigProvider, name string) func(string) interface{} {
+	return func(key string) interface{} {
+		v := config.Get("goss.databases." + name + "." + key)
+		if v == nil && name == DefaultDatabase {
+			v = config.Get("goss.database." + key)
+			if v == nil {
+				v = config.Get("goss." + key)
+			}
+		}
+		return v
+	}
+}
+
 // setupDB creates the database connection pool. This is shared across go-routines for all requests,
 // and the pool management is managed automatically by the sql package.
-func setupDB(config goss.ConfigProvider) error {
+func (d *Database) setupDB(get func(string) interface{}) error {
 	// Get the properties we expect.
-	driverName := config.AsString("goss.database.driverName")
+	driverName, _ := get("driverName").(string)
 	if driverName == "" {
-		return errors.New("goss requires config property goss.database.driverName to be set.")
+		return errors.New("goss requires config property driverName to be set for database '" + d.Name + "'.")
 	}
 
-	dataSourceName := config.AsString("goss.database.dataSourceName")
+	dataSourceName, _ := get("dataSourceName").(string)
 	if dataSourceName == "" {
-		return errors.New("goss requires config property goss.database.dataSourceName to be set.")
+		return errors.New("goss requires config property dataSourceName to be set for database '" + d.Name + "'.")
 	}
 
 	maxIdleConnections := -1 // default is no idle connections
-	mi := config.Get("goss.database.maxIdleConnections")
-	mif, ok := mi.(float64)
+	mif, ok := get("maxIdleConnections").(float64)
 	if ok {
 		maxIdleConnections = int(mif)
 	} else {
-		return errors.New("goss expects config property goss.database.maxIdleConnections to be of type 'int'.")
+		return errors.New("goss expects config property maxIdleConnections of database '" + d.Name + "' to be of type 'int'.")
 
 	}
 
 	// put back in once at go 1.2
 	maxOpenConnections := -1 // default is no limit on open connections
-	mo := config.Get("goss.database.maxOpenConnections")
-	mof, ok := mo.(float64)
+	mof, ok := get("maxOpenConnections").(float64)
 	if ok {
 		maxOpenConnections = int(mof)
 
 	} else {
-		return errors.New("goss expects config property goss.database.maxOpenConnections to be of type 'int'.")
+		return errors.New("goss expects config property maxOpenConnections of database '" + d.Name + "' to be of type 'int'.")
+	}
+
+	// the dialect defaults to the one for the driver.
+	dialectName, _ := get("dialect").(string)
+	if dialectName == "" {
+		dialectName = driverName
+	}
+	d.dialect = DialectFor(dialectName)
+	if d.dialect == nil {
+		return errors.New("goss has no SQL dialect '" + dialectName + "' for database '" + d.Name + "'. Set its dialect property, or use orm.RegisterDialect.")
 	}
 
 	var e error
-	database, e = sql.Open(driverName, dataSourceName)
+	d.db, e = d.dialect.Open(driverName, dataSourceName)
 	if e != nil {
 		return e
 	}
 
-	fmt.Printf("opened database %s: %s\n", driverName, dataSourceName)
+	// the data source name is left out as it may contain a password.
+	slog.Info("opened database", slog.String("database", d.Name), slog.String("driver", driverName))
 
-	database.SetMaxIdleConns(maxIdleConnections)
-	database.SetMaxOpenConns(maxOpenConnections) // requires go 1.2
+	d.db.SetMaxIdleConns(maxIdleConnections)
+	d.db.SetMaxOpenConns(maxOpenConnections) // requires go 1.2
 
-	// @todo hack alert, refactor driver-specific things.
-	if driverName == "mysql" {
-		_, e = database.Query("SET GLOBAL TRANSACTION ISOLATION LEVEL SERIALIZABLE;")
-		_, e = database.Query("SET GLOBAL sql_mode = 'ANSI'")
-	}
 	return nil
 }
 
-func setupMetadata(conf goss.ConfigProvider) error {
-	metadataSource = conf.AsString("goss.metadata")
+// setupMetadata reads the metadata file, or if metadataFromSchema is true, generates the metadata
+// from the database, marking the classes listed in hierarchicalClasses as hierarchical. Generated
+// metadata is written to the metadata file if that is set. If metadataReloadInterval is set, the
+// metadata file is checked at that interval in seconds, and reloaded when it changes.
+func (d *Database) setupMetadata(get func(string) interface{}) error {
+	metadataSource, _ := get("metadata").(string)
+
+	if fromSchema, _ := get("metadataFromSchema").(bool); fromSchema {
+		dbm, e := IntrospectMetadata(d.db, d.Dialect())
+		if e != nil {
+			return errors.New("Could not generate the metadata of database '" + d.Name + "': " + e.Error())
+		}
+		if e = markHierarchical(dbm, get("hierarchicalClasses")); e != nil {
+			return e
+		}
+		d.setMetadata(dbm)
+		if metadataSource == "" {
+			return nil
+		}
+		return dbm.writeFile(metadataSource)
+	}
+
 	if metadataSource == "" {
-		return errors.New("goss requires configuration property goss.metadata is set.")
+		return errors.New("goss requires configuration property metadata is set for database '" + d.Name + "'.")
 	}
 
-	dbMetadata = new(DBMetadata)
-	e := dbMetadata.RefreshOnDemand(metadataSource)
+	// reuse the metadata of the database this replaces if the file hasn't changed.
+	dbm, e := GetDatabase(d.Name).Metadata().RefreshOnDemand(metadataSource)
+	if e != nil {
+		return e
+	}
+	d.setMetadata(dbm)
+
+	interval := get("metadataReloadInterval")
+	if seconds, ok := interval.(float64); ok && seconds > 0 {
+		d.stopMetadataWatch = make(chan bool)
+		go d.watchMetadata(metadataSource, time.Duration(seconds*float64(time.Second)), d.stopMetadataWatch)
+	} else if interval != nil {
+		return errors.New("goss expects config property metadataReloadInterval of database '" + d.Name + "' to be a number of seconds.")
+	}
+	return nil
+}
 
-	fmt.Printf("metadata is %s\n", dbMetadata)
-	return e
+// Mark the classes named in the hierarchicalClasses config property as having the Hierarchy extension.
+func markHierarchical(dbm *DBMetadata, classes interface{}) error {
+	if classes == nil {
+		return nil
+	}
+	names, ok := classes.([]interface{})
+	if !ok {
+		return errors.New("goss expects config property hierarchicalClasses to be an array of class names.")
+	}
+	for _, n := range names {
+		name, _ := n.(string)
+		ci := dbm.GetClass(name)
+		if ci == nil {
+			return fmt.Errorf("Class '%v' in hierarchicalClasses is not in the metadata", n)
+		}
+		ci.Hierarchical = true
+	}
+	return nil
+}
+
+// setupQueryLog configures the default query observer from goss.queryLog.slowThreshold, in seconds,
+// goss.queryLog.all and goss.queryLog.args. It isn't changed if none is set, so an observer set by the
+// application before configuration is kept.
+func setupQueryLog(config goss.ConfigProvider) error {
+	threshold := config.Get("goss.queryLog.slowThreshold")
+	all := config.Get("goss.queryLog.all")
+	args := config.Get("goss.queryLog.args")
+	if threshold == nil && all == nil && args == nil {
+		return nil
+	}
+
+	l := &QueryLog{SlowThreshold: time.Second}
+	if threshold != nil {
+		seconds, ok := threshold.(float64)
+		if !ok {
+			return errors.New("goss expects config property goss.queryLog.slowThreshold to be a number of seconds.")
+		}
+		l.SlowThreshold = time.Duration(seconds * float64(time.Second))
+	}
+	if all != nil {
+		b, ok := all.(bool)
+		if !ok {
+			return errors.New("goss expects config property goss.queryLog.all to be true or false.")
+		}
+		l.All = b
+	}
+	if args != nil {
+		b, ok := args.(bool)
+		if !ok {
+			return errors.New("goss expects config property goss.queryLog.args to be true or false.")
+		}
+		l.Args = b
+	}
+	SetQueryObserver(l.Observe)
+	return nil
 }
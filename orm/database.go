@@ -0,0 +1,192 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Database is a connection pool to a SilverStripe database, along with the metadata that describes it.
+// Databases are configured under goss.databases.<name>, and the default database under goss.database.
+// Package level functions such as NewQuery and Query use the default database; the methods of the same
+// names on Database use that database.
+type Database struct {
+	// The name of the database in the configuration.
+	Name string
+
+	// db is actually a connection pool. The pool is automatically managed, and works across go-routines.
+	db *sql.DB
+
+	// The SQL dialect of the database server.
+	dialect Dialect
+
+	// metadata holds the *DBMetadata in use. When the metadata file changes, the new metadata
+	// replaces it atomically, so queries in progress keep using the metadata they started with.
+	metadata atomic.Value
+
+	// Closed to stop the goroutine that reloads the metadata file, if there is one.
+	stopMetadataWatch chan bool
+}
+
+// DefaultDatabase is the name of the database used when none is specified.
+const DefaultDatabase = "default"
+
+var (
+	databasesLock sync.RWMutex
+	databases     = map[string]*Database{}
+)
+
+// GetDatabase returns the database configured with the given name, or nil if there is none.
+func GetDatabase(name string) *Database {
+	databasesLock.RLock()
+	defer databasesLock.RUnlock()
+	return databases[name]
+}
+
+// Add a database, replacing any of the same name.
+func registerDatabase(d *Database) *Database {
+	databasesLock.Lock()
+	defer databasesLock.Unlock()
+	if old := databases[d.Name]; old != nil && old.stopMetadataWatch != nil {
+		close(old.stopMetadataWatch)
+	}
+	databases[d.Name] = d
+	return d
+}
+
+func defaultDatabase() *Database {
+	return GetDatabase(DefaultDatabase)
+}
+
+var errNoDatabase = errors.New("No database is configured")
+
+// DB returns the connection pool of the database.
+func (d *Database) DB() *sql.DB {
+	if d == nil {
+		return nil
+	}
+	return d.db
+}
+
+// Metadata returns the metadata in use for the database, or nil if none has been loaded.
+func (d *Database) Metadata() *DBMetadata {
+	if d == nil {
+		return nil
+	}
+	dbm, _ := d.metadata.Load().(*DBMetadata)
+	return dbm
+}
+
+func (d *Database) setMetadata(dbm *DBMetadata) {
+	d.metadata.Store(dbm)
+}
+
+// Query executes a SQL query on the database, returning the resulting rows. Caller should ensure that
+// rows.Close is called. Values should always be passed as args, bound to "?" placeholders in sql, and
+// never concatenated into sql.
+func (d *Database) Query(sql string, args ...interface{}) (*sql.Rows, error) {
+	return d.QueryContext(context.Background(), sql, args...)
+}
+
+// QueryContext is Query with a context, which cancels the query when it is done.
+func (d *Database) QueryContext(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, e := d.queryContext(ctx, sql, args...)
+	d.observe(sql, args, start, -1, e)
+	return rows, e
+}
+
+// Execute a query without observing it, for callers that observe it once its rows are read.
+func (d *Database) queryContext(ctx context.Context, sql string, args ...interface{}) (q *sql.Rows, e error) {
+	if d == nil {
+		return nil, errNoDatabase
+	}
+
+	st, e := d.db.PrepareContext(ctx, d.Dialect().Rebind(sql))
+	if e != nil {
+		return
+	}
+	defer st.Close()
+
+	q, e = st.QueryContext(ctx, args...)
+	return
+}
+
+// Exec executes a SQL statement on the database, with args bound to "?" placeholders in sql.
+func (d *Database) Exec(sql string, args ...interface{}) (sql.Result, error) {
+	return d.ExecContext(context.Background(), sql, args...)
+}
+
+// ExecContext is Exec with a context, which cancels the statement when it is done.
+func (d *Database) ExecContext(ctx context.Context, sql string, args ...interface{}) (sql.Result, error) {
+	if d == nil {
+		return nil, errNoDatabase
+	}
+	start := time.Now()
+	res, e := d.db.ExecContext(ctx, d.Dialect().Rebind(sql), args...)
+	d.observe(sql, args, start, rowsAffected(res), e)
+	return res, e
+}
+
+// Return the rows affected by a statement, or -1 if not known.
+func rowsAffected(res sql.Result) int {
+	if res == nil {
+		return -1
+	}
+	n, e := res.RowsAffected()
+	if e != nil {
+		return -1
+	}
+	return int(n)
+}
+
+// NewQuery returns a query for objects of className in this database.
+func (d *Database) NewQuery(className string) DataQuery {
+	q := NewQuerySQL(className).(*DataQuerySQL)
+	q.db = d
+	if d == nil {
+		q.err = errNoDatabase
+	}
+	return q
+}
+
+// IsHierarchical returns true if the class has the Hierarchy extension in this database's metadata.
+func (d *Database) IsHierarchical(className string) bool {
+	return d.Metadata().IsHierarchical(className)
+}
+
+// IsSubclass returns true if className is a subclass of parentClass in this database's metadata.
+func (d *Database) IsSubclass(className string, parentClass string, inclusive bool) (bool, error) {
+	return d.Metadata().IsSubclass(className, parentClass, inclusive)
+}
+
+// TableForMode returns the name of the table to read a class' data from in a reading mode.
+func (d *Database) TableForMode(className string, mode ReadingMode) string {
+	return d.Metadata().TableForMode(className, mode)
+}
+
+// DatabaseObject is implemented by models that keep track of the database they were read from. Objects
+// read by a query are given its database, and their relations are read from, and Write and Delete
+// write to, the same database. Other objects use the default database. control.DataObjectBase
+// implements this.
+type DatabaseObject interface {
+	SetDatabase(*Database)
+	Database() *Database
+}
+
+// Return the database an object belongs to, which is the default database unless obj is a
+// DatabaseObject that has been given a database.
+func databaseOf(obj interface{}) *Database {
+	if o, ok := obj.(DatabaseObject); ok && o.Database() != nil {
+		return o.Database()
+	}
+	return defaultDatabase()
+}
+
+// Return the metadata of the default database.
+func metadata() *DBMetadata {
+	return defaultDatabase().Metadata()
+}
@@ -1,8 +1,8 @@
 package orm
 
-// import (
-// 	"fmt"
-// )
+import (
+	"context"
+)
 
 // DataList represents a set of DataObjects. DataList uses a DataQuery to retrieve values, and does so
 // lazily. It's implementation of Evaluater means that Sort, Filter etc can be chained and appended to the
@@ -34,33 +34,163 @@ func (set *DataListStruct) Append(do interface{}) {
 	set.items = append(set.items, do)
 }
 
+// Set the items of a list whose items have been read already, such as a relation loaded by With.
+func (set *DataListStruct) setItems(items []interface{}) {
+	if items == nil {
+		items = make([]interface{}, 0)
+	}
+	set.items = items
+	set.fetched = true
+}
+
+// Return the list that a change to the query is made on. Once a list is fetched its items don't
+// follow changes to the query, so for a fetched list, such as a relation loaded by With, the change is
+// made to a new list with a copy of the query, which is fetched when it is used. The fetched list and
+// its items are unchanged.
+func (set *DataListStruct) unfetched() *DataListStruct {
+	if !set.fetched {
+		return set
+	}
+	query := set.query
+	if q, ok := query.(*DataQuerySQL); ok {
+		query = q.clone()
+	}
+	return NewDataList(query).(*DataListStruct)
+}
+
 func (set *DataListStruct) Sort(clause string, rest ...string) DataQuery {
-	set.query = set.query.Sort(clause, rest...)
-	return set
+	list := set.unfetched()
+	list.query = list.query.Sort(clause, rest...)
+	return list
+}
+
+func (set *DataListStruct) Reverse() DataQuery {
+	list := set.unfetched()
+	list.query = list.query.Reverse()
+	return list
 }
 
-func (set *DataListStruct) Where(clause interface{}) DataQuery {
-	set.query = set.query.Where(clause)
-	return set
+func (set *DataListStruct) Where(clause string, args ...interface{}) DataQuery {
+	list := set.unfetched()
+	list.query = list.query.Where(clause, args...)
+	return list
+}
+
+func (set *DataListStruct) Filter(filters map[string]interface{}) DataQuery {
+	list := set.unfetched()
+	list.query = list.query.Filter(filters)
+	return list
+}
+
+func (set *DataListStruct) FilterAny(filters map[string]interface{}) DataQuery {
+	list := set.unfetched()
+	list.query = list.query.FilterAny(filters)
+	return list
+}
+
+func (set *DataListStruct) Exclude(filters map[string]interface{}) DataQuery {
+	list := set.unfetched()
+	list.query = list.query.Exclude(filters)
+	return list
 }
 
 func (set *DataListStruct) Limit(offset int, length int) DataQuery {
-	set.query = set.query.Limit(offset, length)
-	return set
+	list := set.unfetched()
+	list.query = list.query.Limit(offset, length)
+	return list
+}
+
+func (set *DataListStruct) SetReadingMode(mode ReadingMode) DataQuery {
+	list := set.unfetched()
+	list.query = list.query.SetReadingMode(mode)
+	return list
+}
+
+func (set *DataListStruct) With(relations ...string) DataQuery {
+	list := set.unfetched()
+	list.query = list.query.With(relations...)
+	return list
+}
+
+func (set *DataListStruct) Count() (int, error) {
+	return set.query.Count()
+}
+
+func (set *DataListStruct) Exists() (bool, error) {
+	return set.query.Exists()
+}
+
+func (set *DataListStruct) Max(field string) (interface{}, error) {
+	return set.query.Max(field)
 }
 
+func (set *DataListStruct) Min(field string) (interface{}, error) {
+	return set.query.Min(field)
+}
+
+func (set *DataListStruct) Sum(field string) (float64, error) {
+	return set.query.Sum(field)
+}
+
+func (set *DataListStruct) Avg(field string) (float64, error) {
+	return set.query.Avg(field)
+}
+
+// Run fetches the items of the list, in the context of the query's transaction if it has one.
 func (set *DataListStruct) Run() (interface{}, error) {
-	res, e := set.query.Run()
+	return set.fetch(set.query.Run())
+}
+
+// RunContext fetches the items of the list, cancelling the query if ctx is done.
+func (set *DataListStruct) RunContext(ctx context.Context) (interface{}, error) {
+	return set.fetch(set.query.RunContext(ctx))
+}
+
+// Keep the items of res, the result of running the list's query.
+func (set *DataListStruct) fetch(res interface{}, e error) (interface{}, error) {
+	if e != nil {
+		return nil, e
+	}
 
+	items, e := res.(DataList).Items()
 	if e != nil {
 		return nil, e
 	}
 
-	// @todo ensure the return type is OK for us.
+	set.items = items
+	set.fetched = true
 
-	set.items = res.([]interface{})
+	return set, nil
+}
 
-	return set.items, nil
+// Each calls fn with each item of the list. If the list hasn't been fetched, the items are streamed
+// from the query rather than fetched, so large lists can be processed without reading them into
+// memory. The items are not kept, so each call to Each executes the query again. The query is run in
+// the context of its transaction if it has one.
+func (set *DataListStruct) Each(fn func(interface{}) error) error {
+	if !set.fetched {
+		return set.query.Each(fn)
+	}
+	return set.eachItem(fn)
+}
+
+// EachContext is Each, cancelling the query if ctx is done. Template loops use this with the
+// request's context.
+func (set *DataListStruct) EachContext(ctx context.Context, fn func(interface{}) error) error {
+	if !set.fetched {
+		return set.query.EachContext(ctx, fn)
+	}
+	return set.eachItem(fn)
+}
+
+// Call fn with each of the fetched items.
+func (set *DataListStruct) eachItem(fn func(interface{}) error) error {
+	for _, item := range set.items {
+		if e := fn(item); e != nil {
+			return e
+		}
+	}
+	return nil
 }
 
 func (set *DataListStruct) Items() ([]interface{}, error) {
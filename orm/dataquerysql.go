@@ -1,93 +1,220 @@
 package orm
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"fmt"
-	"github.com/mrmorphic/goss/data"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
 )
 
-// database is actually a connection pool. The pool is automatically managed, and works across go-routines.
-var database *sql.DB
+// Execute a SQL query on the default database, returning the resulting rows. Caller should ensure that
+// rows.Close is called. Values should always be passed as args, bound to "?" placeholders in sql, and
+// never concatenated into sql.
+func Query(sql string, args ...interface{}) (*sql.Rows, error) {
+	return defaultDatabase().Query(sql, args...)
+}
 
-// Execute a SQL query, returning the resulting rows. Caller should ensure that rows.Close is called.
-func Query(sql string) (q *sql.Rows, e error) {
-	fmt.Printf("sql: %s\n", sql)
-	st, e := database.Prepare(sql)
-	if e != nil {
-		return
-	}
-	defer st.Close()
+// QueryContext is Query with a context, which cancels the query when it is done.
+func QueryContext(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+	return defaultDatabase().QueryContext(ctx, sql, args...)
+}
 
-	q, e = st.Query()
-	return
+// Execute a SQL statement on the default database, with args bound to "?" placeholders in sql.
+func Exec(sql string, args ...interface{}) (sql.Result, error) {
+	return defaultDatabase().Exec(sql, args...)
 }
 
-// Execute a SQL statement.
-func Exec(sql string) (sql.Result, error) {
-	return database.Exec(sql)
+// ExecContext is Exec with a context, which cancels the statement when it is done.
+func ExecContext(ctx context.Context, sql string, args ...interface{}) (sql.Result, error) {
+	return defaultDatabase().ExecContext(ctx, sql, args...)
 }
 
 // DataQuerySQL is an implementer of DataQuery for SQL databases.
 type DataQuerySQL struct {
+	joins     []string
 	where     []string
+	args      []interface{}
 	columns   []string
-	orderBy   string
+	orderBy   []sortTerm
 	start     int
 	limit     int
 	baseClass string
+	mode      ReadingMode
+
+	// The database the query reads. If nil, the query reads the default database.
+	db *Database
+
+	// The transaction the query is run in, if any.
+	tx *Tx
+
+	// Tables added by InnerJoin, which can be referred to in sort clauses.
+	joinTables []string
+
+	// Columns of joined tables that are selected in addition to the class' own columns, such as the
+	// extra fields of a many_many join table. Maps the field name to its qualified column.
+	extraFields map[string]string
+
+	// The SilverStripe types of extra fields, where these are known.
+	extraTypes map[string]string
+
+	// Relations that are loaded for all of the objects when the query is run. See With.
+	with []string
+
+	// The first error from building the query, such as an invalid filter. Chainable methods can't return
+	// errors, so this is returned when the query is run.
+	err error
+}
+
+// Return a copy of the query that can be changed without changing q.
+func (q *DataQuerySQL) clone() *DataQuerySQL {
+	c := *q
+	c.joins = append([]string(nil), q.joins...)
+	c.where = append([]string(nil), q.where...)
+	c.args = append([]interface{}(nil), q.args...)
+	c.columns = append([]string(nil), q.columns...)
+	c.orderBy = append([]sortTerm(nil), q.orderBy...)
+	c.joinTables = append([]string(nil), q.joinTables...)
+	c.with = append([]string(nil), q.with...)
+	c.extraFields = copyStringMap(q.extraFields)
+	c.extraTypes = copyStringMap(q.extraTypes)
+	return &c
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
 }
 
-func (q *DataQuerySQL) Where(clause interface{}) DataQuery {
-	s := clause.(string)
-	q.where = append(q.where, s)
+func (q *DataQuerySQL) Where(clause string, args ...interface{}) DataQuery {
+	q.where = append(q.where, clause)
+	q.args = append(q.args, args...)
 	return q
 }
 
-func (q *DataQuerySQL) Sort(clause string, rest ...string) DataQuery {
-	q.orderBy = clause
+func (q *DataQuerySQL) SetReadingMode(mode ReadingMode) DataQuery {
+	q.mode = mode
 	return q
 }
 
 func (q *DataQuerySQL) Run() (interface{}, error) {
-	sql, e := q.sql()
+	return q.RunContext(q.context())
+}
+
+// RunContext executes the query, cancelling it if ctx is done.
+func (q *DataQuerySQL) RunContext(ctx context.Context) (interface{}, error) {
+	var items []interface{}
+	e := q.EachContext(ctx, func(obj interface{}) error {
+		items = append(items, obj)
+		return nil
+	})
 	if e != nil {
 		return nil, e
 	}
 
-	// ensure rows are closed. Implication is that this function must read all rows, can't
-	// leave the query open for incremental reading.
-	res, e := Query(sql)
-	defer res.Close()
+	// the list is fetched even if there are no items, so its Items don't run the query again.
+	set := NewDataList(q).(*DataListStruct)
+	set.setItems(items)
+	return set, nil
+}
+
+// Each executes the query and calls fn with each object as its row is read, so the result set is
+// never held in memory. If fn returns an error, iteration stops and the error is returned. The rows
+// are always closed before Each returns.
+func (q *DataQuerySQL) Each(fn func(interface{}) error) error {
+	return q.EachContext(q.context(), fn)
+}
 
+// EachContext is Each, cancelling the query if ctx is done.
+func (q *DataQuerySQL) EachContext(ctx context.Context, fn func(interface{}) error) error {
+	if len(q.with) > 0 {
+		return q.eachWithRelations(ctx, fn)
+	}
+	return q.each(ctx, func(obj interface{}, key int) error {
+		return fn(obj)
+	})
+}
+
+// Execute the query and call fn with each object as its row is read. If the query selects the
+// relationKeyColumn, its value is passed to fn as key rather than set on the object; otherwise key
+// is 0.
+func (q *DataQuerySQL) each(ctx context.Context, fn func(obj interface{}, key int) error) error {
+	sql, args, e := q.sql()
 	if e != nil {
-		fmt.Printf("ERROR EXECUTING SQL: %s\n", e)
-		return nil, e
+		return e
 	}
+	ci, _ := q.classInfo()
 
-	set := NewDataList(q)
+	start := time.Now()
+	res, e := q.query(ctx, sql, args...)
+	if e != nil {
+		q.database().observe(sql, args, start, 0, e)
+		return e
+	}
+
+	n := 0
+	defer func() {
+		q.database().observe(sql, args, start, n, res.Err())
+	}()
+	defer res.Close()
 
 	for res.Next() {
-		obj, e := DataObjectFromRow(res)
+		n++
+		cols, raw, e := scanRow(res)
 		if e != nil {
-			return nil, e
+			return e
 		}
-		set.Append(obj)
-	}
 
-	return set, nil
+		key := 0
+		for i, c := range cols {
+			if c == relationKeyColumn {
+				if key, e = columnInt(raw[i]); e != nil {
+					return e
+				}
+				cols = append(cols[:i:i], cols[i+1:]...)
+				raw = append(raw[:i:i], raw[i+1:]...)
+				break
+			}
+		}
 
+		obj, e := dataObjectFromColumns(q.database(), q.mode, ci, q.extraTypes, cols, raw)
+		if e != nil {
+			return e
+		}
+		if e = fn(obj, key); e != nil {
+			return e
+		}
+	}
+	return res.Err()
 }
 
-func (q *DataQuerySQL) Columns(columns []string) DataQuery {
-	q.columns = columns
+// InnerJoin adds an inner join of table to the query, on the given condition. The table is not
+// aliased, so the condition and other clauses refer to it by name.
+func (q *DataQuerySQL) InnerJoin(table string, on string) DataQuery {
+	q.joins = append(q.joins, "inner join "+quoteIdentifier(table)+" on "+on)
+	q.joinTables = append(q.joinTables, table)
+	return q
+}
+
+// SelectExtraField adds a column of a joined table to the columns returned for each object, as the
+// field name. column is a qualified column reference.
+func (q *DataQuerySQL) SelectExtraField(name string, column string) DataQuery {
+	if q.extraFields == nil {
+		q.extraFields = make(map[string]string)
+	}
+	q.extraFields[name] = column
 	return q
 }
 
-func (q *DataQuerySQL) Count(column string) DataQuery {
+func (q *DataQuerySQL) Columns(columns []string) DataQuery {
+	q.columns = columns
 	return q
 }
 
@@ -97,46 +224,152 @@ func (q *DataQuerySQL) Limit(start, number int) DataQuery {
 	return q
 }
 
-func (q *DataQuerySQL) Filter(field string, filterValue interface{}) DataQuery {
-	return q
+// Filter restricts the query to objects matching all of the filters. See filter.go for the syntax.
+func (q *DataQuerySQL) Filter(filters map[string]interface{}) DataQuery {
+	return q.addFilter(filters, "and", false)
+}
+
+// FilterAny restricts the query to objects matching any of the filters.
+func (q *DataQuerySQL) FilterAny(filters map[string]interface{}) DataQuery {
+	return q.addFilter(filters, "or", false)
+}
+
+// Exclude removes objects that match all of the filters from the query.
+func (q *DataQuerySQL) Exclude(filters map[string]interface{}) DataQuery {
+	return q.addFilter(filters, "and", true)
+}
+
+// Return the select list used when no columns have been specified. This selects all columns of each
+// of the class' tables, base table last. Subclass tables have their own ID column, which is null when
+// a left joined descendent row doesn't exist, so the base table columns must come last to take
+// precedence when the row is read. Extra fields of a join follow.
+func (q *DataQuerySQL) defaultColumns(baseClass *ClassInfo) string {
+	var cols []string
+	for i := len(baseClass.descendentTables) - 1; i >= 0; i-- {
+		cols = append(cols, quoteIdentifier(baseClass.descendentTables[i].TableName)+".*")
+	}
+	for i := len(baseClass.tables) - 1; i >= 0; i-- {
+		cols = append(cols, quoteIdentifier(baseClass.tables[i].TableName)+".*")
+	}
+
+	var extra []string
+	for name := range q.extraFields {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		cols = append(cols, q.extraFields[name]+" "+quoteIdentifier(name))
+	}
+
+	if baseClass.Versioned && q.mode.readsVersions() {
+		// in the _versions tables ID identifies the version, so make sure ID comes through
+		// as the ID of the record.
+		cols = append(cols, quoteIdentifier(baseClass.baseClass().TableName)+".\"RecordID\" \"ID\"")
+	}
+	return strings.Join(cols, ",")
+}
+
+// Generate the from and where clauses of the query, and the arguments to bind to them. These are
+// common to fetching objects and aggregates.
+func (q *DataQuerySQL) fromWhere(baseClass *ClassInfo) (string, []interface{}) {
+	// Tables. This is basically a join of all tables from base DataObject thru to the table for the class, and all
+	// tables for subclasses. This will have been precalculated for stage and live, so it's trivial here.
+	sql := "from " + baseClass.from(q.mode)
+	for _, j := range q.joins {
+		sql += " " + j
+	}
+
+	// where clause. The class' own condition comes first, so its arguments precede the query's.
+	where, args := baseClass.where(q.mode)
+	sql += " where " + where
+	args = append(args, q.args...)
+	if len(q.where) > 0 {
+		sql += " and " + strings.Join(q.where, " and ")
+	}
+	return sql, args
 }
 
-// Generate the SQL for this DataQuery
-func (q *DataQuerySQL) sql() (s string, e error) {
+// Return the ClassInfo of the class being queried, or an error if the query can't be run.
+func (q *DataQuerySQL) classInfo() (*ClassInfo, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
 	if q.baseClass == "" {
-		return "", errors.New("No base class")
+		return nil, errors.New("No base class")
+	}
+
+	baseClass := q.metadata().GetClass(q.baseClass)
+	if baseClass == nil || baseClass.baseClass() == nil {
+		return nil, errors.New("Class '" + q.baseClass + "' is not in the metadata or has no table")
+	}
+	return baseClass, nil
+}
+
+// Return the database the query reads.
+func (q *DataQuerySQL) database() *Database {
+	if q.db != nil {
+		return q.db
+	}
+	return defaultDatabase()
+}
+
+// Return the context for running the query when none is given, which is the context of its
+// transaction if it has one.
+func (q *DataQuerySQL) context() context.Context {
+	if q.tx != nil {
+		return q.tx.ctx
+	}
+	return context.Background()
+}
+
+// Execute SQL for the query, in its transaction if it has one. The caller observes the query when it
+// has read the rows.
+func (q *DataQuerySQL) query(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+	if q.tx != nil {
+		return q.tx.queryContext(ctx, sql, args...)
+	}
+	return q.database().queryContext(ctx, sql, args...)
+}
+
+func (q *DataQuerySQL) metadata() *DBMetadata {
+	return q.database().Metadata()
+}
+
+// Generate the SQL for this DataQuery, and the arguments to bind to its placeholders.
+func (q *DataQuerySQL) sql() (s string, args []interface{}, e error) {
+	baseClass, e := q.classInfo()
+	if e != nil {
+		return "", nil, e
 	}
 
 	// columns
 	sql := "select "
 	if len(q.columns) == 0 {
-		sql += "* "
+		sql += q.defaultColumns(baseClass) + " "
 	} else {
 		sql += "\"" + strings.Join(q.columns, "\",\"") + "\" "
 	}
 
-	// Tables. This is basically a join of all tables from base DataObject thru to the table for the class, and all
-	// tables for subclasses. This will have been precalculated, so it's trivial here.
-	baseClass := dbMetadata.GetClass(q.baseClass)
-	sql += "from " + baseClass.defaultFrom
-
-	// where clause
-	sql += " where " + baseClass.defaultWhere
-	if len(q.where) > 0 {
-		sql += " and " + strings.Join(q.where, " and ")
-	}
+	fromWhere, args := q.fromWhere(baseClass)
+	sql += fromWhere
 
-	if q.orderBy != "" {
-		sql += " order by " + q.orderBy
+	if len(q.orderBy) > 0 {
+		var terms []string
+		for _, t := range q.orderBy {
+			terms = append(terms, t.String())
+		}
+		sql += " order by " + strings.Join(terms, ",")
 	}
 
 	if q.start >= 0 {
-		sql += " limit " + strconv.Itoa(q.start) + ", " + strconv.Itoa(q.limit)
+		sql += " " + q.database().Dialect().Limit(q.start, q.limit)
 	}
 	//	fmt.Printf("query is %s\n", sql)
-	return sql, nil
+	return sql, args, nil
 }
 
+// NewQuery returns a query for objects of className in the default database.
 func NewQuery(className string) DataQuery {
 	return NewQuerySQL(className)
 }
@@ -145,86 +378,53 @@ func NewQuerySQL(className string) DataQuery {
 	q := new(DataQuerySQL)
 	q.start = -1
 	q.baseClass = className
+	q.mode = defaultReadingMode
 	return q
 }
 
+// DataObjectFromRow reads the current row of r, from the default database, into a new object. The
+// object is an instance of the model registered for the row's ClassName, or a DataObjectMap if there is
+// none. Values are converted to Go types according to the class' fields in the metadata.
 func DataObjectFromRow(r *sql.Rows) (interface{}, error) {
-	// Get columns
-	cols, e := r.Columns()
-	colCount := len(cols)
-	classNameCol := -1
-
-	var field []interface{}
-	for i := 0; i < colCount; i++ {
-		if cols[i] == "ClassName" {
-			classNameCol = i
-		}
-		switch {
-		case cols[i][:2] == "b:":
-			field = append(field, new(sql.NullBool))
-		case cols[i][:2] == "f:":
-			field = append(field, new(sql.NullFloat64))
-		case cols[i][:2] == "i:":
-			field = append(field, new(sql.NullInt64))
-		case cols[i][:2] == "s:":
-			field = append(field, new(sql.NullString))
-		case cols[i][:2] == "t:":
-			field = append(field, new(time.Time))
-		default:
-			field = append(field, new(sql.NullString))
-		}
-	}
-
-	//fmt.Printf("cols are %s\n", cols)
-	//fmt.Printf("there are %d columns\n", colCount)
-	//fmt.Println("about to scan values")
-	// get associated value
-	e = r.Scan(field...)
-
-	//fmt.Println("scanned fields")
+	cols, raw, e := scanRow(r)
 	if e != nil {
-		fmt.Printf("got an error though: %s\n", e)
 		return nil, e
 	}
+	return dataObjectFromColumns(defaultDatabase(), defaultReadingMode, nil, nil, cols, raw)
+}
 
+// Create an object from the columns of a row read from db in the given reading mode. Column types are
+// taken from ci, which is the class of the row if nil, and extraTypes.
+func dataObjectFromColumns(db *Database, mode ReadingMode, ci *ClassInfo, extraTypes map[string]string, cols []string, raw []interface{}) (interface{}, error) {
 	className := ""
-	if classNameCol >= 0 {
-		className = flatten(field[classNameCol]).(string)
+	for i, c := range cols {
+		if c == "ClassName" {
+			className = columnString(raw[i])
+		}
+	}
+	if ci == nil {
+		ci = db.Metadata().GetClass(className)
 	}
 
 	m := GetModelInstance(className)
-	// m := NewDataObjectMap()
-	mdo, ok := m.(DataObject)
-
+	if o, ok := m.(DatabaseObject); ok {
+		o.SetDatabase(db)
+	}
+	if o, ok := m.(ReadingModeObject); ok {
+		o.SetReadingMode(mode)
+	}
 	for i, c := range cols {
-		v := flatten(field[i])
-		if ok {
+		ssType, ok := extraTypes[c]
+		if !ok {
+			ssType = ci.columnType(c)
+		}
 
-			mdo.Set(c, v)
-		} else {
-			// doesn't implement DataObject, so may be a plain struct, so use data package.
-			data.Set(m, c, v)
+		v, e := convertColumn(ssType, raw[i])
+		if e != nil {
+			return nil, errors.New("Column '" + c + "': " + e.Error())
 		}
+		setField(m, c, v)
 	}
 
 	return m, nil
 }
-
-// This is a bit hassly. When we copy over field values, we need to ignore the Valid property
-// of each field, since SilverStripe effectively uses the zero values when underlying
-// SQL field is null. Without this conversion, all consumers of data object need to be aware
-// of sql package field values.
-func flatten(sqlField interface{}) interface{} {
-	switch v := sqlField.(type) {
-	case *sql.NullBool:
-		return v.Bool
-	case *sql.NullFloat64:
-		return v.Float64
-	case *sql.NullInt64:
-		return v.Int64
-	case *sql.NullString:
-		return v.String
-	}
-
-	return sqlField
-}
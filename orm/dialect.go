@@ -0,0 +1,255 @@
+package orm
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Dialect handles the differences between the SQL of the database servers goss can read from. The
+// SQL goss generates uses ANSI double quoted identifiers and "?" placeholders, as do Where clauses
+// passed to DataQuery, so a dialect must accept double quoted identifiers, such as by setting MySQL's
+// ANSI mode in Open, and rewrites placeholders with Rebind if its driver needs something else.
+type Dialect interface {
+	// Name of the dialect, e.g. "mysql"
+	Name() string
+
+	// Open returns the connection pool for a data source, setting up each connection as goss needs.
+	Open(driverName string, dataSourceName string) (*sql.DB, error)
+
+	// Limit returns the clause that limits a select to n rows starting at start, which is 0 based.
+	Limit(start int, n int) string
+
+	// Bool returns the literal for a value of a SilverStripe Boolean field.
+	Bool(b bool) string
+
+	// CaseSensitive returns an expression of column for comparing case sensitively.
+	CaseSensitive(column string) string
+
+	// Rebind rewrites the "?" placeholders of a statement as the driver expects them.
+	Rebind(sql string) string
+
+	// Insert executes an insert statement, with "?" placeholders, into a table with an
+	// auto-incrementing "ID" column, and returns the ID of the new row.
+	Insert(ctx context.Context, tx *sql.Tx, sql string, args ...interface{}) (int64, error)
+}
+
+var (
+	dialectsLock sync.RWMutex
+
+	// dialects by driver name
+	dialects = map[string]Dialect{
+		"mysql":    MySQL,
+		"postgres": PostgreSQL,
+		"sqlite3":  SQLite,
+		"sqlite":   SQLite,
+	}
+)
+
+// The dialects provided by goss.
+var (
+	MySQL      Dialect = mysqlDialect{}
+	PostgreSQL Dialect = postgresDialect{}
+	SQLite     Dialect = sqliteDialect{}
+)
+
+// RegisterDialect sets the dialect to use for databases opened with the given driver name. Dialects
+// for the usual drivers of MySQL ("mysql"), PostgreSQL ("postgres") and SQLite ("sqlite3" and
+// "sqlite") are registered already.
+func RegisterDialect(driverName string, d Dialect) {
+	dialectsLock.Lock()
+	defer dialectsLock.Unlock()
+	dialects[driverName] = d
+}
+
+// DialectFor returns the dialect for a driver name, or the dialect with that name, or nil if there
+// is none.
+func DialectFor(name string) Dialect {
+	dialectsLock.RLock()
+	defer dialectsLock.RUnlock()
+	if d := dialects[name]; d != nil {
+		return d
+	}
+	for _, d := range dialects {
+		if d.Name() == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// ansiDialect provides the parts of the dialects that follow the SQL standard.
+type ansiDialect struct{}
+
+func (ansiDialect) Open(driverName string, dataSourceName string) (*sql.DB, error) {
+	return sql.Open(driverName, dataSourceName)
+}
+
+func (ansiDialect) Limit(start int, n int) string {
+	return "limit " + strconv.Itoa(n) + " offset " + strconv.Itoa(start)
+}
+
+// SilverStripe stores Boolean fields as small integers in each of the databases it supports.
+func (ansiDialect) Bool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func (ansiDialect) Rebind(sql string) string {
+	return sql
+}
+
+func (ansiDialect) Insert(ctx context.Context, tx *sql.Tx, sql string, args ...interface{}) (int64, error) {
+	res, e := tx.ExecContext(ctx, sql, args...)
+	if e != nil {
+		return 0, e
+	}
+	return res.LastInsertId()
+}
+
+// mysqlDialect is for MySQL with github.com/go-sql-driver/mysql. Connections use ANSI mode so that
+// double quoted identifiers work, and serializable transactions. These are set per connection
+// through the data source, so they don't affect the SilverStripe site sharing the server. A data
+// source that sets sql_mode itself must include ANSI or ANSI_QUOTES, or Open fails.
+type mysqlDialect struct {
+	ansiDialect
+}
+
+func (mysqlDialect) Name() string {
+	return "mysql"
+}
+
+func (mysqlDialect) Open(driverName string, dataSourceName string) (*sql.DB, error) {
+	if mode, ok := dsnParam(dataSourceName, "sql_mode"); ok && !hasANSIQuotes(mode) {
+		return nil, errors.New("goss requires MySQL's ANSI_QUOTES mode, but the data source sets sql_mode without it. Add ANSI_QUOTES to its sql_mode, or leave sql_mode out to use ANSI mode.")
+	}
+	dataSourceName = withDSNParam(dataSourceName, "sql_mode", "'ANSI'")
+	dataSourceName = withDSNParam(dataSourceName, "transaction_isolation", "'SERIALIZABLE'")
+	return sql.Open(driverName, dataSourceName)
+}
+
+func (mysqlDialect) Limit(start int, n int) string {
+	return "limit " + strconv.Itoa(start) + ", " + strconv.Itoa(n)
+}
+
+func (mysqlDialect) CaseSensitive(column string) string {
+	return "binary " + column
+}
+
+// Add a parameter to a go-sql-driver/mysql data source, unless it already has it.
+func withDSNParam(dataSourceName string, name string, value string) string {
+	if strings.Contains(dataSourceName, "?"+name+"=") || strings.Contains(dataSourceName, "&"+name+"=") {
+		return dataSourceName
+	}
+	sep := "?"
+	if strings.Contains(dataSourceName, "?") {
+		sep = "&"
+	}
+	return dataSourceName + sep + name + "=" + url.QueryEscape(value)
+}
+
+// Return the value of a parameter of a go-sql-driver/mysql data source, and whether it is set.
+// Parameters follow the "?" after the database name.
+func dsnParam(dataSourceName string, name string) (string, bool) {
+	query := dataSourceName[strings.LastIndex(dataSourceName, "/")+1:]
+	i := strings.Index(query, "?")
+	if i < 0 {
+		return "", false
+	}
+	params, e := url.ParseQuery(query[i+1:])
+	if e != nil {
+		return "", false
+	}
+	v, ok := params[name]
+	if !ok || len(v) == 0 {
+		return "", false
+	}
+	return v[0], true
+}
+
+// Return true if a MySQL sql_mode, such as "'ANSI,TRADITIONAL'", makes double quotes quote
+// identifiers.
+func hasANSIQuotes(mode string) bool {
+	for _, m := range strings.Split(strings.Trim(mode, "'\""), ",") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m == "ANSI" || m == "ANSI_QUOTES" {
+			return true
+		}
+	}
+	return false
+}
+
+// postgresDialect is for PostgreSQL with github.com/lib/pq, which uses numbered placeholders and
+// doesn't support LastInsertId.
+type postgresDialect struct {
+	ansiDialect
+}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+// Comparisons are case sensitive in PostgreSQL already.
+func (postgresDialect) CaseSensitive(column string) string {
+	return column
+}
+
+// Rebind replaces the "?" placeholders with $1, $2 etc. Question marks in quoted strings and
+// identifiers are left alone.
+func (postgresDialect) Rebind(sql string) string {
+	var b bytes.Buffer
+	var quote rune
+	n := 0
+	for _, c := range sql {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (d postgresDialect) Insert(ctx context.Context, tx *sql.Tx, sql string, args ...interface{}) (int64, error) {
+	var id int64
+	e := tx.QueryRowContext(ctx, d.Rebind(sql+" returning "+quoteIdentifier("ID")), args...).Scan(&id)
+	return id, e
+}
+
+// sqliteDialect is for SQLite with github.com/mattn/go-sqlite3 or modernc.org/sqlite. An in-memory
+// database is private to a connection, so it should be configured with maxOpenConnections of 1.
+type sqliteDialect struct {
+	ansiDialect
+}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) CaseSensitive(column string) string {
+	return column + " collate binary"
+}
+
+// Return the dialect of a database, which is MySQL if it hasn't been set, as goss was originally
+// written for MySQL.
+func (d *Database) Dialect() Dialect {
+	if d == nil || d.dialect == nil {
+		return MySQL
+	}
+	return d.dialect
+}
@@ -7,10 +7,24 @@ import (
 
 // This is a basic implementation of DataObject, to be used when the ORM returns an object
 // from the database where the ClassName is not registered. The object is represented as a map.
+// Maps read by a query hold the query's database and reading mode, so their relations are read from,
+// and Write and Delete write to, the database they came from, and relations are read in the same mode.
 type DataObjectMap map[string]interface{}
 
+// The key of the database a map was read from. It is not a field of the class, so it isn't written.
+const databaseKey = "goss_Database"
+
+// The key of the reading mode of the query a map was read by.
+const readingModeKey = "goss_ReadingMode"
+
+// Get returns the value of a field. If the map has no such field but the object's class has a relation
+// of that name, the relation is fetched.
 func (obj DataObjectMap) Get(fieldName string, args ...interface{}) interface{} {
-	return obj[fieldName]
+	if v, ok := obj[fieldName]; ok {
+		return v
+	}
+	v, _ := resolveRelation(obj, fieldName)
+	return v
 }
 
 // Return string representation of the field
@@ -29,11 +43,48 @@ func (obj DataObjectMap) Set(fieldName string, value interface{}) {
 func (obj DataObjectMap) Debug() string {
 	s := "DataObject:\n"
 	for f, v := range obj {
-		s += fmt.Sprintf("  %s: %s\n", f, v)
+		if f != databaseKey && f != readingModeKey {
+			s += fmt.Sprintf("  %s: %s\n", f, v)
+		}
 	}
 	return s
 }
 
+// SetDatabase records the database the object was read from or written to.
+func (obj DataObjectMap) SetDatabase(db *Database) {
+	obj[databaseKey] = db
+}
+
+// Database returns the database the object was read from, or nil if it hasn't been read or written.
+func (obj DataObjectMap) Database() *Database {
+	db, _ := obj[databaseKey].(*Database)
+	return db
+}
+
+// SetReadingMode records the reading mode of the query the object was read by.
+func (obj DataObjectMap) SetReadingMode(mode ReadingMode) {
+	obj[readingModeKey] = mode
+}
+
+// ReadingMode returns the reading mode the object was read in. It is the zero ReadingMode if the
+// object wasn't read by a query.
+func (obj DataObjectMap) ReadingMode() ReadingMode {
+	mode, _ := obj[readingModeKey].(ReadingMode)
+	return mode
+}
+
+// SetLoadedRelation stores a relation loaded by DataQuery.With in the map, so Get returns it without
+// querying. It isn't written by Write, as it's not a field of the class.
+func (obj DataObjectMap) SetLoadedRelation(name string, value interface{}) {
+	obj[name] = value
+}
+
+// LoadedRelation returns a relation stored by SetLoadedRelation.
+func (obj DataObjectMap) LoadedRelation(name string) (interface{}, bool) {
+	v, ok := obj[name]
+	return v, ok
+}
+
 func NewDataObjectMap() DataObjectMap {
 	return map[string]interface{}{}
 }
@@ -0,0 +1,223 @@
+package orm
+
+import (
+	"context"
+	"errors"
+	"github.com/mrmorphic/goss/convert"
+	"strings"
+)
+
+// This file implements eager loading of relations with DataQuery.With. Accessing a relation of each
+// object returned by a query takes a query per object. Instead, each relation named by With is read
+// for all of the objects at once, using "in" conditions on their IDs, and attached to the objects.
+
+// The alias of the column that holds, for each row of a query loading a relation, the ID that relates
+// it to the objects being loaded for. It is read by each, and not set on the object.
+const relationKeyColumn = "goss_RelationKey"
+
+// The most IDs put in a single "in" condition. Relations of more objects are read in batches, to stay
+// within the limits databases put on the number of placeholders.
+const eagerBatchSize = 500
+
+// RelationHolder is implemented by models that can hold relations loaded by DataQuery.With.
+// GetRelation, and hence templates, return a loaded relation without querying. DataObjectMap
+// implements it by storing the relation in the map, and control.DataObjectBase implements it for
+// models that embed it. Models that do neither can hold a relation in a field named after it, of a
+// type the relation's value can be assigned to.
+type RelationHolder interface {
+	// SetLoadedRelation stores the value of the named relation.
+	SetLoadedRelation(name string, value interface{})
+
+	// LoadedRelation returns the value of the named relation, and false if it hasn't been loaded.
+	LoadedRelation(name string) (interface{}, bool)
+}
+
+// With names relations of the queried class that are loaded for all of the objects when the query is
+// run, e.g. With("Author", "Tags"). Each relation is read with one query for all of the objects,
+// rather than one query per object when it is accessed. The values are those GetRelation would
+// return, with the items of lists already fetched. When relations are loaded, Each reads all of the
+// objects before calling fn.
+func (q *DataQuerySQL) With(relations ...string) DataQuery {
+	q.with = append(q.with, relations...)
+	return q
+}
+
+// Read all of the objects of the query, load the relations named by With, then call fn with each.
+func (q *DataQuerySQL) eachWithRelations(ctx context.Context, fn func(interface{}) error) error {
+	var items []interface{}
+	e := q.each(ctx, func(obj interface{}, key int) error {
+		items = append(items, obj)
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+
+	if len(items) > 0 {
+		for _, name := range q.with {
+			if e = q.loadRelation(ctx, items, name); e != nil {
+				return e
+			}
+		}
+	}
+
+	for _, item := range items {
+		if e = fn(item); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Load the named relation for each of items, and attach it to them.
+func (q *DataQuerySQL) loadRelation(ctx context.Context, items []interface{}, name string) error {
+	ci, e := q.classInfo()
+	if e != nil {
+		return e
+	}
+
+	r := ci.relation(name)
+	if r == nil {
+		return errors.New("Class '" + q.baseClass + "' has no relation '" + name + "'")
+	}
+
+	related := q.metadata().GetClass(r.ClassName)
+	if related == nil || related.baseClass() == nil {
+		return errors.New("Class '" + r.ClassName + "' is not in the metadata")
+	}
+
+	if r.Kind == HasOne {
+		return q.loadHasOne(ctx, items, related, r)
+	}
+	return q.loadList(ctx, items, related, r)
+}
+
+// Load a has_one relation, reading the related objects by the IDs in the foreign key of items.
+func (q *DataQuerySQL) loadHasOne(ctx context.Context, items []interface{}, related *ClassInfo, r *Relation) error {
+	var ids []int
+	for _, item := range items {
+		ids = append(ids, intField(item, r.ForeignKey))
+	}
+
+	byID := make(map[int]interface{})
+	e := q.eachRelated(ctx, ids, func() (*DataQuerySQL, string) {
+		rq := q.relatedQuery(r.ClassName)
+		return rq, related.idRef(rq.mode)
+	}, func(obj interface{}, id int) error {
+		byID[id] = obj
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+
+	for _, item := range items {
+		if e = attachRelation(item, r.Name, byID[intField(item, r.ForeignKey)]); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Load a has_many, many_many or belongs_many_many relation, reading the related objects of all of
+// items and giving each item a fetched list of its own.
+func (q *DataQuerySQL) loadList(ctx context.Context, items []interface{}, related *ClassInfo, r *Relation) error {
+	var ids []int
+	for _, item := range items {
+		ids = append(ids, intField(item, "ID"))
+	}
+
+	byOwner := make(map[int][]interface{})
+	e := q.eachRelated(ctx, ids, func() (*DataQuerySQL, string) {
+		rq := q.relatedQuery(r.ClassName)
+		return rq, joinRelation(rq, related, r)
+	}, func(obj interface{}, ownerID int) error {
+		byOwner[ownerID] = append(byOwner[ownerID], obj)
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+
+	db := q.database()
+	for _, item := range items {
+		id := intField(item, "ID")
+
+		var list *DataListStruct
+		var value interface{}
+		if r.Kind == HasMany {
+			list = NewDataList(relationQuery(db, relationMode(q.mode), related, r, id)).(*DataListStruct)
+			value = list
+		} else {
+			mm := newManyManyList(db, relationMode(q.mode), related, r, id)
+			list = mm.DataListStruct
+			value = mm
+		}
+		list.setItems(byOwner[id])
+
+		if e = attachRelation(item, r.Name, value); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Run queries made by newQuery for the distinct, non-zero IDs, in batches. newQuery returns the query
+// and the column the IDs are matched against, and fn is called with each object read and its value
+// of that column.
+func (q *DataQuerySQL) eachRelated(ctx context.Context, ids []int, newQuery func() (*DataQuerySQL, string), fn func(obj interface{}, key int) error) error {
+	seen := make(map[int]bool)
+	var distinct []interface{}
+	for _, id := range ids {
+		if id != 0 && !seen[id] {
+			seen[id] = true
+			distinct = append(distinct, id)
+		}
+	}
+
+	for len(distinct) > 0 {
+		batch := distinct
+		if len(batch) > eagerBatchSize {
+			batch = batch[:eagerBatchSize]
+		}
+		distinct = distinct[len(batch):]
+
+		rq, column := newQuery()
+		rq.SelectExtraField(relationKeyColumn, column)
+		rq.Where(column+" in ("+strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")+")", batch...)
+		if e := rq.each(ctx, fn); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Return a query for related objects, in the same database, transaction and reading mode as the query.
+func (q *DataQuerySQL) relatedQuery(className string) *DataQuerySQL {
+	rq := q.database().NewQuery(className).(*DataQuerySQL)
+	rq.tx = q.tx
+	rq.mode = relationMode(q.mode)
+	return rq
+}
+
+// Attach the value of a loaded relation to obj, returning an error if obj can't hold it.
+func attachRelation(obj interface{}, name string, value interface{}) error {
+	if h, ok := obj.(RelationHolder); ok {
+		h.SetLoadedRelation(name, value)
+		return nil
+	}
+	if setModelField(obj, name, value) {
+		return nil
+	}
+
+	v, _ := fieldValue(obj, "ClassName")
+	className, _ := v.(string)
+	return errors.New("Class '" + className + "' can't hold relation '" + name + "'")
+}
+
+// Return the value of an integer field of obj, or 0 if it doesn't have one.
+func intField(obj interface{}, name string) int {
+	v, _ := fieldValue(obj, name)
+	i, _ := convert.AsInt(v)
+	return i
+}
@@ -0,0 +1,238 @@
+package orm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// This file implements SilverStripe's search filter syntax for DataQuery.Filter, FilterAny and Exclude.
+// Filter keys are a field name, optionally followed by a search filter and modifiers, separated by
+// colons, e.g. "Title", "Title:PartialMatch", "Title:PartialMatch:nocase" or "Created:GreaterThan".
+// The search filters are:
+//  * ExactMatch (the default): field equals the value. If the value is a slice, the field matches
+//    any of the values. A nil value matches null.
+//  * PartialMatch, StartsWith, EndsWith: the field contains, starts with or ends with the value. If the
+//    value is a slice, the field matches any of them.
+//  * GreaterThan, GreaterThanOrEqual, LessThan, LessThanOrEqual: compares the field to a single value.
+// The modifiers are:
+//  * case, nocase: force a case sensitive or insensitive comparison. Without either, the comparison
+//    depends on the collation of the field in the database.
+//  * not: negates the condition.
+// Boolean values are compared using the database dialect's literals, so
+// Filter(map[string]interface{}{"ShowInMenus": true}) works whichever way the database stores Boolean
+// fields.
+
+// searchFilter is a parsed filter key.
+type searchFilter struct {
+	field  string
+	filter string
+
+	// one of "", "case" or "nocase"
+	caseMode string
+
+	negate bool
+}
+
+// Comparison operators for the filters that compare against a single value.
+var comparisonFilters = map[string]string{
+	"GreaterThan":        ">",
+	"GreaterThanOrEqual": ">=",
+	"LessThan":           "<",
+	"LessThanOrEqual":    "<=",
+}
+
+// Patterns for the filters that use like. The value replaces the "?".
+var likeFilters = map[string]string{
+	"PartialMatch": "%?%",
+	"StartsWith":   "?%",
+	"EndsWith":     "%?",
+}
+
+func parseFilterKey(key string) (*searchFilter, error) {
+	parts := strings.Split(key, ":")
+	f := &searchFilter{field: parts[0], filter: "ExactMatch"}
+	if f.field == "" {
+		return nil, errors.New("Filter '" + key + "' has no field name")
+	}
+
+	for i, p := range parts[1:] {
+		switch {
+		case p == "case" || p == "nocase":
+			f.caseMode = p
+		case p == "not":
+			f.negate = true
+		case i == 0 && (p == "ExactMatch" || comparisonFilters[p] != "" || likeFilters[p] != ""):
+			f.filter = p
+		default:
+			return nil, errors.New("Filter '" + key + "' has unknown search filter or modifier '" + p + "'")
+		}
+	}
+	return f, nil
+}
+
+// Generate the condition for this filter against a column, with its bound arguments.
+func (f *searchFilter) condition(dialect Dialect, column string, value interface{}) (string, []interface{}, error) {
+	values, isList := filterValues(value)
+	var cond string
+	var args []interface{}
+
+	switch {
+	case f.filter == "ExactMatch":
+		switch {
+		case !isList && value == nil:
+			cond = column + " is null"
+		case isList && len(values) == 0:
+			// nothing can match an empty list
+			cond = "1=0"
+		case !isList && isBool(value):
+			cond = column + "=" + dialect.Bool(value.(bool))
+		case isList:
+			cond = f.caseColumn(dialect, column) + " in (" + strings.TrimSuffix(strings.Repeat(f.caseValue("?")+",", len(values)), ",") + ")"
+			args = values
+		default:
+			cond = f.caseColumn(dialect, column) + "=" + f.caseValue("?")
+			args = values
+		}
+	case comparisonFilters[f.filter] != "":
+		if isList {
+			return "", nil, errors.New("Filter " + f.filter + " on '" + f.field + "' requires a single value")
+		}
+		cond = f.caseColumn(dialect, column) + comparisonFilters[f.filter] + f.caseValue("?")
+		args = values
+	default:
+		// like filters. A list matches any of the values.
+		var terms []string
+		for _, v := range values {
+			terms = append(terms, f.caseColumn(dialect, column)+" like "+f.caseValue("?"))
+			args = append(args, strings.Replace(likeFilters[f.filter], "?", fmt.Sprintf("%v", v), 1))
+		}
+		switch len(terms) {
+		case 0:
+			cond = "1=0"
+		case 1:
+			cond = terms[0]
+		default:
+			cond = "(" + strings.Join(terms, " or ") + ")"
+		}
+	}
+
+	if f.negate {
+		cond = "not (" + cond + ")"
+	}
+	return cond, args, nil
+}
+
+// Apply the case modifier to a column.
+func (f *searchFilter) caseColumn(dialect Dialect, column string) string {
+	switch f.caseMode {
+	case "nocase":
+		return "lower(" + column + ")"
+	case "case":
+		return dialect.CaseSensitive(column)
+	}
+	return column
+}
+
+func (f *searchFilter) caseValue(placeholder string) string {
+	if f.caseMode == "nocase" {
+		return "lower(" + placeholder + ")"
+	}
+	return placeholder
+}
+
+func isBool(value interface{}) bool {
+	_, ok := value.(bool)
+	return ok
+}
+
+// Return the values of a filter as a slice, and whether it was given as a list. Byte slices are
+// treated as single values.
+func filterValues(value interface{}) ([]interface{}, bool) {
+	v := reflect.ValueOf(value)
+	if value == nil || (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) || v.Type().Elem().Kind() == reflect.Uint8 {
+		return []interface{}{value}, false
+	}
+
+	result := make([]interface{}, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		result[i] = v.Index(i).Interface()
+	}
+	return result, true
+}
+
+// Generate the conditions of a filter map, combined with "and" or "or", along with the bound arguments.
+// Keys are processed in sorted order so the generated SQL is stable.
+func (q *DataQuerySQL) filterConditions(filters map[string]interface{}, combine string) (string, []interface{}, error) {
+	ci := q.metadata().GetClass(q.baseClass)
+	if ci == nil {
+		return "", nil, errors.New("Class '" + q.baseClass + "' is not in the metadata")
+	}
+
+	var keys []string
+	for k := range filters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var conds []string
+	var args []interface{}
+	for _, k := range keys {
+		f, e := parseFilterKey(k)
+		if e != nil {
+			return "", nil, e
+		}
+
+		column, e := q.fieldColumn(ci, f.field)
+		if e != nil {
+			return "", nil, e
+		}
+		cond, a, e := f.condition(q.database().Dialect(), column, filters[k])
+		if e != nil {
+			return "", nil, e
+		}
+		conds = append(conds, cond)
+		args = append(args, a...)
+	}
+
+	return strings.Join(conds, " "+combine+" "), args, nil
+}
+
+// Return the quoted column reference for a field of the query's objects, which must be a field of the
+// class' tables or an extra field of a join. Field names can come from requests, so anything else is
+// an error rather than being put in the SQL.
+func (q *DataQuerySQL) fieldColumn(ci *ClassInfo, field string) (string, error) {
+	if ref, ok := q.extraFields[field]; ok {
+		return ref, nil
+	}
+	if !ci.hasField(field) {
+		return "", errors.New("Class '" + ci.ClassName + "' has no field '" + field + "'")
+	}
+	return ci.columnRef(field), nil
+}
+
+// Add a filter condition to the query. Errors are held until the query is run.
+func (q *DataQuerySQL) addFilter(filters map[string]interface{}, combine string, negate bool) DataQuery {
+	if len(filters) == 0 {
+		return q
+	}
+
+	cond, args, e := q.filterConditions(filters, combine)
+	if e != nil {
+		if q.err == nil {
+			q.err = e
+		}
+		return q
+	}
+
+	if negate {
+		cond = "not (" + cond + ")"
+	} else {
+		cond = "(" + cond + ")"
+	}
+	q.where = append(q.where, cond)
+	q.args = append(q.args, args...)
+	return q
+}
@@ -0,0 +1,94 @@
+package orm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mrmorphic/goss/data"
+	"reflect"
+)
+
+// GroupedList is a list of items that can be grouped for output, like SilverStripe's GroupedList. It
+// is a slice, so templates can loop over it directly, and GroupedBy returns the groups, each with its
+// items as Children:
+//
+//	<% loop $Posts.GroupedBy("Month") %>
+//		<h2>$Month</h2>
+//		<% loop $Children %>$Title<% end_loop %>
+//	<% end_loop %>
+type GroupedList []interface{}
+
+// Group is one of the groups returned by GroupedList.GroupedBy. As well as Key, templates can refer
+// to the key by the name of the field the list was grouped by, e.g. $Month.
+type Group struct {
+	// The value of the field that the items of the group have.
+	Key interface{}
+
+	// The items of the group, in their order in the list. These can be grouped again.
+	Children GroupedList
+
+	// the field the list was grouped by
+	field string
+}
+
+// NewGroupedList returns a GroupedList of the items of list, which is a DataList or a slice. A
+// DataList is fetched.
+func NewGroupedList(list interface{}) (GroupedList, error) {
+	if dl, ok := list.(DataList); ok {
+		items, e := dl.Items()
+		if e != nil {
+			return nil, e
+		}
+		return GroupedList(items), nil
+	}
+
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, errors.New("GroupedList requires a DataList or a slice")
+	}
+	result := make(GroupedList, v.Len())
+	for i := range result {
+		result[i] = v.Index(i).Interface()
+	}
+	return result, nil
+}
+
+// GroupedBy groups the items by the value of a field, which may also be a method, such as one that
+// returns the month of a date. Groups are in the order their first item appears in the list. Values
+// are compared as strings, so nil and "" are the same group.
+func (l GroupedList) GroupedBy(field string) []*Group {
+	result := []*Group{}
+	byKey := make(map[string]*Group)
+	for _, item := range l {
+		key := data.Eval(item, field)
+		s := ""
+		if key != nil {
+			s = fmt.Sprint(key)
+		}
+		g := byKey[s]
+		if g == nil {
+			g = &Group{Key: key, field: field}
+			byKey[s] = g
+			result = append(result, g)
+		}
+		g.Children = append(g.Children, item)
+	}
+	return result
+}
+
+// Count returns the number of items in the list.
+func (l GroupedList) Count() int {
+	return len(l)
+}
+
+// resolveGroupKey lets templates refer to the key of a Group by the name of the field it was grouped
+// by.
+func resolveGroupKey(context interface{}, name string, args ...interface{}) (interface{}, bool) {
+	if g, ok := context.(*Group); ok && len(args) == 0 && name == g.field {
+		return g.Key, true
+	}
+	return nil, false
+}
+
+func init() {
+	data.RegisterResolver(resolveGroupKey)
+}
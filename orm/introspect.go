@@ -0,0 +1,313 @@
+package orm
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// This file derives DBMetadata from the schema of a SilverStripe database, as an alternative to the
+// metadata file generated by the silverstripe-goss module. The schema gives us:
+//  * the classes of each hierarchy, from the ClassName enum of its base table
+//  * which classes have tables, and the fields and types of those tables
+//  * which classes are versioned, from the presence of _Live and _versions tables
+//  * that SiteTree has the Hierarchy extension, if it has a ParentID field. Other classes can have the
+//    extension, such as File, but a ParentID field doesn't show that they do, so these have to be
+//    marked Hierarchical by the caller.
+// The schema doesn't record which class extends which. This is worked out from the data: a record of
+// a class has a row in the table of each of its ancestors, and an ancestor's table has at least as
+// many rows as its descendent's table. A class with no records is given the base class and its own
+// table as ancestors. Relations aren't derived, as the schema doesn't say which class a foreign key
+// refers to. As the ancestry of subclasses is inferred, their InferredAncestry is set, and their
+// objects can't be written.
+//
+// This reads MySQL's information_schema, so only MySQL databases are supported; other dialects are an
+// error.
+
+// schemaTable is a table of the database, with its columns in order.
+type schemaTable struct {
+	name    string
+	columns []schemaColumn
+}
+
+type schemaColumn struct {
+	name string
+
+	// The column type as given by the database, e.g. "varchar(255)" or "enum('SiteTree','Page')"
+	sqlType string
+}
+
+// IntrospectMetadata generates the metadata of a SilverStripe database from its schema and data. The
+// dialect is that of the database, which must be MySQL.
+func IntrospectMetadata(db *sql.DB, dialect Dialect) (*DBMetadata, error) {
+	if dialect != MySQL {
+		name := "an unknown dialect"
+		if dialect != nil {
+			name = dialect.Name()
+		}
+		return nil, errors.New("goss can only generate metadata from the schema of MySQL databases, not " + name)
+	}
+
+	tables, e := readSchema(db)
+	if e != nil {
+		return nil, e
+	}
+
+	dbm := &DBMetadata{}
+	if e = db.QueryRow("select database()").Scan(&dbm.DBIdentifier); e != nil {
+		return nil, e
+	}
+
+	for _, t := range tables {
+		classes := baseTableClasses(t)
+		if classes == nil {
+			continue
+		}
+
+		ancestors, e := introspectAncestors(db, dialect, t.name, classes, tables)
+		if e != nil {
+			return nil, e
+		}
+		dbm.Classes = append(dbm.Classes, hierarchyClasses(classes, ancestors, tables)...)
+	}
+
+	dbm.precache()
+	return dbm, nil
+}
+
+// Read the tables and columns of the current database.
+func readSchema(db *sql.DB) (map[string]*schemaTable, error) {
+	rows, e := db.Query("select table_name, column_name, column_type from information_schema.columns " +
+		"where table_schema=database() order by table_name, ordinal_position")
+	if e != nil {
+		return nil, e
+	}
+	defer rows.Close()
+
+	tables := make(map[string]*schemaTable)
+	for rows.Next() {
+		var table string
+		var c schemaColumn
+		if e = rows.Scan(&table, &c.name, &c.sqlType); e != nil {
+			return nil, e
+		}
+		if tables[table] == nil {
+			tables[table] = &schemaTable{name: table}
+		}
+		tables[table].columns = append(tables[table].columns, c)
+	}
+	return tables, rows.Err()
+}
+
+// If t is the base table of a hierarchy, return the values of its ClassName enum, which are the
+// classes of the hierarchy. Returns nil for other tables, including _Live and _versions tables.
+func baseTableClasses(t *schemaTable) []string {
+	if strings.HasSuffix(t.name, "_Live") || strings.HasSuffix(t.name, "_versions") {
+		return nil
+	}
+
+	for _, c := range t.columns {
+		if c.name != "ClassName" {
+			continue
+		}
+		values := strings.ToLower(c.sqlType)
+		if !strings.HasPrefix(values, "enum('") || !strings.HasSuffix(values, "')") {
+			return nil
+		}
+		var classes []string
+		for _, v := range strings.Split(c.sqlType[len("enum('"):len(c.sqlType)-len("')")], "','") {
+			classes = append(classes, strings.Replace(v, "''", "'", -1))
+		}
+		return classes
+	}
+	return nil
+}
+
+// Work out the ancestors of each class in a hierarchy from the data. For each class that has records,
+// its ancestors are the tables that have a row for one of them, ordered by decreasing row count.
+func introspectAncestors(db *sql.DB, dialect Dialect, base string, classes []string, tables map[string]*schemaTable) (map[string][]string, error) {
+	counts := make(map[string]int)
+	for _, c := range classes {
+		if tables[c] == nil || c == base {
+			continue
+		}
+		var n int
+		if e := db.QueryRow("select count(*) from " + quoteIdentifier(c)).Scan(&n); e != nil {
+			return nil, e
+		}
+		counts[c] = n
+	}
+
+	result := make(map[string][]string)
+	for _, c := range classes {
+		var id int
+		e := db.QueryRow("select "+quoteIdentifier("ID")+" from "+quoteIdentifier(base)+" where "+
+			quoteIdentifier("ClassName")+"=? "+dialect.Limit(0, 1), c).Scan(&id)
+		if e == sql.ErrNoRows {
+			continue
+		}
+		if e != nil {
+			return nil, e
+		}
+
+		var withRecord []string
+		for t := range counts {
+			var n int
+			e := db.QueryRow("select count(*) from "+quoteIdentifier(t)+" where "+quoteIdentifier("ID")+"=?", id).Scan(&n)
+			if e != nil {
+				return nil, e
+			}
+			if n > 0 {
+				withRecord = append(withRecord, t)
+			}
+		}
+		result[c] = orderAncestors(base, withRecord, counts, classes)
+	}
+	return result, nil
+}
+
+// Order the tables of a record's ancestors from the base down. An ancestor's table has at least as
+// many rows as its descendents' tables; ties are broken by the order of the ClassName enum, which
+// lists classes before their subclasses.
+func orderAncestors(base string, tables []string, counts map[string]int, classes []string) []string {
+	position := make(map[string]int)
+	for i, c := range classes {
+		position[c] = i
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		if counts[tables[i]] != counts[tables[j]] {
+			return counts[tables[i]] > counts[tables[j]]
+		}
+		return position[tables[i]] < position[tables[j]]
+	})
+	return append([]string{base}, tables...)
+}
+
+// Generate the ClassInfo of each class in a hierarchy. ancestors has the ancestors that have tables of
+// the classes that have records; each class is added as the last of its ancestors if it has no table.
+func hierarchyClasses(classes []string, ancestors map[string][]string, tables map[string]*schemaTable) []*ClassInfo {
+	base := classes[0]
+	versioned := tables[base+"_Live"] != nil && tables[base+"_versions"] != nil
+
+	var result []*ClassInfo
+	for _, c := range classes {
+		a, ok := ancestors[c]
+		if !ok {
+			// no records, so all we know is the base class and whether the class has a table
+			a = []string{base}
+		}
+		if a[len(a)-1] != c {
+			a = append(a, c)
+		}
+
+		ci := &ClassInfo{ClassName: c, TableName: c, HasTable: tables[c] != nil, Versioned: versioned, Ancestors: a, InferredAncestry: c != base}
+		if ci.HasTable {
+			ci.Fields = tableFields(tables[c])
+			for _, f := range ci.Fields {
+				// the Hierarchy extension adds ParentID to the table of the class it's applied to.
+				// Other classes may have a ParentID that isn't from Hierarchy.
+				if f.Name == "ParentID" && c == "SiteTree" {
+					ci.Hierarchical = true
+				}
+			}
+		}
+		result = append(result, ci)
+	}
+
+	// descendents are the classes that have the class as an ancestor, in enum order.
+	for _, ci := range result {
+		for _, d := range result {
+			if d == ci {
+				continue
+			}
+			for _, a := range d.Ancestors {
+				if a == ci.ClassName {
+					ci.Descendents = append(ci.Descendents, d.ClassName)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// Return the fields of a class' table, other than the system fields in the base table.
+func tableFields(t *schemaTable) []*DBField {
+	var fields []*DBField
+	for _, c := range t.columns {
+		if systemFields[c.name] {
+			continue
+		}
+		fields = append(fields, &DBField{Name: c.name, SSType: ssTypeOf(c)})
+	}
+	return fields
+}
+
+// Return the SilverStripe field type for a column type. Types that map to several SilverStripe types
+// are given the most general, e.g. text columns are Text rather than HTMLText.
+func ssTypeOf(c schemaColumn) string {
+	t := strings.ToLower(c.sqlType)
+	base := t
+	if i := strings.IndexAny(base, "( "); i >= 0 {
+		base = base[:i]
+	}
+
+	switch base {
+	case "tinyint":
+		if strings.HasPrefix(t, "tinyint(1)") {
+			return "Boolean"
+		}
+		fallthrough
+	case "int", "smallint", "mediumint", "bigint":
+		if strings.HasSuffix(c.name, "ID") {
+			return "ForeignKey"
+		}
+		return "Int"
+	case "decimal":
+		return "Decimal"
+	case "float", "double":
+		return "Float"
+	case "date":
+		return "Date"
+	case "datetime", "timestamp":
+		return "SS_Datetime"
+	case "time":
+		return "Time"
+	case "year":
+		return "Year"
+	case "enum":
+		return "Enum"
+	case "set":
+		return "MultiEnum"
+	case "text", "mediumtext", "longtext", "tinytext":
+		return "Text"
+	}
+	return "Varchar"
+}
+
+// WriteJSON writes the metadata in the format of the metadata file, so it can be read by
+// RefreshOnDemand.
+func (dbm *DBMetadata) WriteJSON(w io.Writer) error {
+	b, e := json.MarshalIndent(struct {
+		DBIdentifier string
+		Classes      []*ClassInfo
+	}{dbm.DBIdentifier, dbm.Classes}, "", "\t")
+	if e != nil {
+		return e
+	}
+	_, e = w.Write(b)
+	return e
+}
+
+// Write the metadata to a file in the format of the metadata file.
+func (dbm *DBMetadata) writeFile(path string) error {
+	f, e := os.Create(path)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	return dbm.WriteJSON(f)
+}
@@ -0,0 +1,87 @@
+package orm
+
+import (
+	"errors"
+	"github.com/mrmorphic/goss/convert"
+)
+
+// ManyManyList is the DataList returned for many_many and belongs_many_many relations, similar to
+// SilverStripe's ManyManyList. Each item has the extra fields of the join table as well as its own
+// fields. The extra fields can be used in sorting and filtering by referring to them qualified with
+// the join table name, e.g. "Page_Tags"."SortOrder".
+type ManyManyList struct {
+	*DataListStruct
+
+	relation *Relation
+
+	// ID of the object that owns the relation.
+	ownerID int
+
+	// The database of the owner, where the join table is.
+	db *Database
+}
+
+func newManyManyList(db *Database, mode ReadingMode, related *ClassInfo, r *Relation, ownerID int) *ManyManyList {
+	set := NewDataList(relationQuery(db, mode, related, r, ownerID)).(*DataListStruct)
+	return &ManyManyList{DataListStruct: set, relation: r, ownerID: ownerID, db: db}
+}
+
+// ExtraFields returns the names of the extra fields of the join table.
+func (l *ManyManyList) ExtraFields() []string {
+	var result []string
+	for _, f := range l.relation.ExtraFields {
+		result = append(result, f.Name)
+	}
+	return result
+}
+
+// JoinTable returns the name of the join table, for qualifying extra fields in Where and Sort.
+func (l *ManyManyList) JoinTable() string {
+	return l.relation.JoinTable
+}
+
+// Add adds item to the relation, with the given values of extra fields, which may be nil. item must
+// already have been written. The list is not refetched.
+func (l *ManyManyList) Add(item interface{}, extraFields map[string]interface{}) error {
+	id, e := itemID(item)
+	if e != nil {
+		return e
+	}
+
+	columns := []string{l.relation.ForeignKey, l.relation.LocalKey}
+	values := []interface{}{l.ownerID, id}
+	for _, f := range l.relation.ExtraFields {
+		if v, ok := extraFields[f.Name]; ok {
+			columns = append(columns, f.Name)
+			values = append(values, v)
+		}
+	}
+
+	_, e = l.db.Exec(insertSQL(l.relation.JoinTable, columns), values...)
+	return e
+}
+
+// Remove removes item from the relation. The item itself is not deleted.
+func (l *ManyManyList) Remove(item interface{}) error {
+	id, e := itemID(item)
+	if e != nil {
+		return e
+	}
+
+	_, e = l.db.Exec("delete from "+quoteIdentifier(l.relation.JoinTable)+" where "+
+		quoteIdentifier(l.relation.ForeignKey)+"=? and "+quoteIdentifier(l.relation.LocalKey)+"=?", l.ownerID, id)
+	return e
+}
+
+// Return the ID of an object that has been written.
+func itemID(item interface{}) (int, error) {
+	v, _ := fieldValue(item, "ID")
+	id, e := convert.AsInt(v)
+	if e != nil {
+		return 0, e
+	}
+	if id == 0 {
+		return 0, errors.New("Object must be written before it can be added to or removed from a relation")
+	}
+	return id, nil
+}
@@ -3,9 +3,12 @@ package orm
 import (
 	"bufio"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
+	"log/slog"
 	"os"
+	"strings"
+	"time"
 )
 
 // This file handles things to do with the metadata that generated a database we're connecting with.
@@ -23,8 +26,14 @@ type DBMetadata struct {
 
 	// Map of class name to ClassInfo object.
 	ClassMap map[string]*ClassInfo
+
+	// The file the metadata was read from, and its modification time when it was read.
+	source  string
+	modTime time.Time
 }
 
+// DBField describes a database field defined by a class, as declared in the class' $db (and has_one)
+// config. Only fields the class itself declares are listed; inherited fields belong to the ancestor.
 type DBField struct {
 	Name   string
 	SSType string
@@ -38,7 +47,21 @@ type ClassInfo struct {
 	TableName   string
 	Ancestors   []string
 	Descendents []string
-	//	Fields []*DBField
+
+	// The database fields the class declares. Filter and Sort only accept these and the system
+	// columns, so every field that is queried must be listed.
+	Fields    []*DBField
+	Relations []*Relation
+
+	// True if the class has the Hierarchy extension. Its subclasses are hierarchical too.
+	Hierarchical bool
+
+	// True if Ancestors was inferred from the data, as IntrospectMetadata does for subclasses, rather
+	// than declared. Inferred ancestry may leave out classes, such as those without tables, which
+	// IsSubclass then doesn't know about. Objects of the class can't be written or deleted, as that
+	// could leave rows out of their tables.
+	InferredAncestry bool `json:",omitempty"`
+
 	//	SuperClasses []*ClassInfo
 	//	SubClasses []*ClassInfo
 
@@ -47,44 +70,92 @@ type ClassInfo struct {
 	defaultFrom string
 
 	// Likewise we'll precalculate a part of the where clause that selects ClassName being the base class or
-	// any of its descendents.
-	defaultWhere string
-}
+	// any of its descendents. The class names are bound to its placeholders, as namespaced class names
+	// contain backslashes, which MySQL treats as escapes in string literals.
+	defaultWhere     string
+	defaultWhereArgs []interface{}
+
+	// The same as defaultFrom, but for reading live data.
+	liveFrom string
+
+	// The descendent classes that have tables. These are left joined so their fields are available.
+	descendentTables []*ClassInfo
 
-var Databases map[string]*DBMetadata
+	// Relations of this class and its ancestors, by name.
+	relations map[string]*Relation
 
-func init() {
-	Databases = make(map[string]*DBMetadata)
+	// The classes from the base class down to this class that have tables, in that order. Writes
+	// are split across these.
+	tables []*ClassInfo
+
+	// SilverStripe types of the columns read for this class, by column name.
+	columnTypes map[string]string
 }
 
 // Refresh this metadata object from the metadata source file provided. We only actually do that under two circumstances:
-// - we have not initialised yet
-// - the metadata file has a modification time that is more recent than when we last refreshed.
-func (dbm *DBMetadata) RefreshOnDemand(metadataSource string) error {
+// - we have not initialised yet (dbm is nil)
+// - the metadata file has a modification time that is different from when we last refreshed.
+// dbm is never modified, as queries may be using it. Instead the new metadata is returned, or dbm
+// itself if the file hasn't changed.
+func (dbm *DBMetadata) RefreshOnDemand(metadataSource string) (*DBMetadata, error) {
 	// fmt.Printf("DBMetadata::RefreshOnDemand called with %s\n", metadataSource)
 
-	// @todo check if file has changed since we last read it. Return if it hasn't.
+	info, err := os.Stat(metadataSource)
+	if err != nil {
+		return dbm, err
+	}
+	if dbm != nil && dbm.source == metadataSource && info.ModTime().Equal(dbm.modTime) {
+		return dbm, nil
+	}
 
 	file, err := os.Open(metadataSource)
 	if err != nil {
-		return err
+		return dbm, err
 	}
+	defer file.Close()
 
-	// Read the json file. This is marshalled directly into dbm.
+	// Read the json file. This is marshalled directly into the new metadata.
+	result := &DBMetadata{source: metadataSource, modTime: info.ModTime()}
 	decoder := json.NewDecoder(bufio.NewReader(file))
-	err = decoder.Decode(&dbm)
+	err = decoder.Decode(result)
 	if err != nil && err != io.EOF {
-		return err
+		// the file may be part way through being written, in which case the next refresh will
+		// read it.
+		return dbm, err
 	}
 
 	// for c, def := range dbm.Classes {
 	// 	fmt.Printf("Class define for class %s is %s\n", c, def)
 	// }
 
-	dbm.precache()
+	result.precache()
 
-	fmt.Printf("After loading metadata, dbm now looks like %s\n", dbm)
-	return nil
+	return result, nil
+}
+
+// watchMetadata checks the metadata file for changes every interval, and replaces the database's
+// metadata when it changes. It returns when stop is closed.
+func (d *Database) watchMetadata(metadataSource string, interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			current := d.Metadata()
+			dbm, e := current.RefreshOnDemand(metadataSource)
+			if e != nil {
+				slog.Error("could not reload metadata", slog.String("database", d.Name), slog.String("file", metadataSource), slog.Any("error", e))
+				continue
+			}
+			if dbm != current {
+				d.setMetadata(dbm)
+				slog.Info("reloaded metadata", slog.String("database", d.Name), slog.String("file", metadataSource))
+			}
+		}
+	}
 }
 
 // After loading metadata from the JSON file, we then pre-calculate some cached info that makes the ORM faster. As much as possible we want to bypass looking up classes
@@ -98,16 +169,19 @@ func (dbm *DBMetadata) precache() {
 	// fmt.Printf("before precache, class map is %s\n", dbm.ClassMap)
 	for _, c := range dbm.Classes {
 		c.precacheDefaultFromWhere(dbm)
+		c.precacheColumnTypes()
+	}
+	for _, c := range dbm.Classes {
+		c.precacheRelations(dbm)
 	}
 }
 
-// Calculate the defaultFrom property, which is going to be a join clause
+// Calculate the defaultFrom property, which is going to be a join clause, and defaultWhere. liveFrom is
+// the same join but reading from the _Live tables of versioned classes.
 func (ci *ClassInfo) precacheDefaultFromWhere(dbm *DBMetadata) {
-	fromClause := ""
-	whereClause := ""
-	first := true
-	lastTable := ""
 	rootTable := ""
+	ci.tables = nil
+	ci.descendentTables = nil
 
 	// fmt.Printf("precacheDefaultFromWhere: class info is %s\n", ci)
 
@@ -121,70 +195,168 @@ func (ci *ClassInfo) precacheDefaultFromWhere(dbm *DBMetadata) {
 		}
 
 		if a.HasTable {
-			if !first {
-				fromClause += " inner join "
-			}
-			fromClause += "\"" + a.TableName + "\" \"" + a.TableName + "\""
-			if !first {
-				fromClause += " on \"" + lastTable + "\".\"ID\"=\"" + a.TableName + "\".\"ID\""
-			}
-			first = false
-			lastTable = a.TableName
+			ci.tables = append(ci.tables, a)
 		}
 	}
 
-	// Join all ancestors leading up to this class, including the class itself, but only where a class has a table.
+	// Left join all descendents, so that subclass fields are returned as well.
 	// fmt.Printf("... processing descendents\n")
-	whereClause = "(\"" + rootTable + "\".\"ClassName\"='" + ci.ClassName + "'"
+	classNames := []interface{}{ci.ClassName}
 	for _, c := range ci.Descendents {
 		d := dbm.GetClass(c)
 		// fmt.Printf("...looking up descendent class %s\n", c)
 		if d == nil {
-			fmt.Printf("class %s could not be found\n", c)
+			slog.Warn("descendent class is not in the metadata", slog.String("class", ci.ClassName), slog.String("descendent", c))
+			continue
 		}
 		if d.HasTable {
-			fromClause += " left join "
-			fromClause += "\"" + d.TableName + "\" \"" + d.TableName + "\""
-			fromClause += " on \"" + lastTable + "\".\"ID\"=\"" + d.TableName + "\".\"ID\""
+			ci.descendentTables = append(ci.descendentTables, d)
+		}
+		classNames = append(classNames, d.ClassName)
+	}
+
+	ci.defaultFrom = ci.fromClause(Stage)
+	ci.liveFrom = ci.fromClause(Live)
+	ci.defaultWhere = quoteIdentifier(rootTable) + ".\"ClassName\" in (" + strings.TrimSuffix(strings.Repeat("?,", len(classNames)), ",") + ")"
+	ci.defaultWhereArgs = classNames
+}
+
+// Generate the join of the class' tables for a reading mode. Each table is aliased to its unsuffixed
+// table name, so where and order by clauses can refer to "SiteTree" regardless of which of SiteTree,
+// SiteTree_Live or SiteTree_versions is actually being read.
+func (ci *ClassInfo) fromClause(mode ReadingMode) string {
+	fromClause := ""
+	lastTable := ""
+	for i, t := range ci.tables {
+		if i > 0 {
+			fromClause += " inner join "
+		}
+		fromClause += t.tableRef(mode)
+		if i > 0 {
+			fromClause += " on " + mode.joinCondition(lastTable, t.TableName)
 		}
-		whereClause += " or \"" + rootTable + "\".\"ClassName\"='" + d.ClassName + "'"
+		lastTable = t.TableName
+	}
+
+	for _, d := range ci.descendentTables {
+		fromClause += " left join " + d.tableRef(mode) + " on " + mode.joinCondition(lastTable, d.TableName)
+	}
+	return fromClause
+}
+
+// Return the FROM clause for a query on this class in the given reading mode. The stage and live
+// clauses are precalculated.
+func (ci *ClassInfo) from(mode ReadingMode) string {
+	switch {
+	case !ci.Versioned || mode == Stage:
+		return ci.defaultFrom
+	case mode == Live:
+		return ci.liveFrom
+	}
+	return ci.fromClause(mode)
+}
+
+// Return the WHERE clause that restricts a query on this class to the class and its descendents, and
+// its arguments. In archived mode this also selects the latest version of each record as at the
+// archive date.
+func (ci *ClassInfo) where(mode ReadingMode) (string, []interface{}) {
+	// copied, as the caller appends to the arguments
+	args := append([]interface{}{}, ci.defaultWhereArgs...)
+	if !ci.Versioned || !mode.IsArchived() {
+		return ci.defaultWhere, args
+	}
+
+	base := quoteIdentifier(ci.baseClass().TableName)
+	return ci.defaultWhere + " and " + base + ".\"Version\"=(select max(\"v\".\"Version\") from " +
+		quoteIdentifier(ci.baseClass().TableName+"_versions") + " \"v\" where \"v\".\"RecordID\"=" + base +
+		".\"RecordID\" and \"v\".\"LastEdited\"<=?)", append(args, mode.date.Format(datetimeFormat))
+}
 
+// Return the table reference for this class' table in a reading mode, aliased to its own table name.
+func (ci *ClassInfo) tableRef(mode ReadingMode) string {
+	t := ci.TableName
+	if ci.Versioned {
+		t += mode.suffix()
 	}
-	whereClause += ")"
+	return quoteIdentifier(t) + " " + quoteIdentifier(ci.TableName)
+}
 
-	//	fmt.Printf("precache: calculated defaultFrom for class %s: %s\n\n\n", ci.ClassName, fromClause)
-	ci.defaultFrom = fromClause
-	//	fmt.Printf("precache: calculated defaultWhere for class %s: %s\n\n\n", ci.ClassName, whereClause)
-	ci.defaultWhere = whereClause
+// Return the ClassInfo of the base class, which is the first ancestor with a table. This holds
+// the ID, ClassName, Created and LastEdited fields.
+func (ci *ClassInfo) baseClass() *ClassInfo {
+	if len(ci.tables) == 0 {
+		return nil
+	}
+	return ci.tables[0]
 }
 
+// Return true if the class or one of its ancestors has the Hierarchy extension.
 func (dbm *DBMetadata) IsHierarchical(className string) bool {
-	// @todo implement
-	if className == "SiteTree" || className == "ProjectPage" || className == "EntryPage" || className == "ProjectHolder" || className == "SpecialProjectPage" || className == "HomePage" || className == "FeedbackPage" || className == "MessagesPage" || className == "Page" {
-		return true
+	c := dbm.GetClass(className)
+	if c == nil {
+		return false
+	}
+	for _, a := range c.Ancestors {
+		if ac := dbm.GetClass(a); ac != nil && ac.Hierarchical {
+			return true
+		}
 	}
 	return false
 }
 
 func (dbm *DBMetadata) IsVersioned(className string) bool {
-	// @todo implement
 	c := dbm.GetClass(className)
-	return c.Versioned
+	return c != nil && c.Versioned
+}
+
+// Return the table that holds a class' own fields in the given reading mode. Returns "" if the class
+// is not known or has no table.
+func (dbm *DBMetadata) TableForMode(className string, mode ReadingMode) string {
+	c := dbm.GetClass(className)
+	if c == nil || !c.HasTable {
+		return ""
+	}
+	if c.Versioned {
+		return c.TableName + mode.suffix()
+	}
+	return c.TableName
 }
 
 // Return a ClassInfo and all it's defined properties given a class name.
 func (dbm *DBMetadata) GetClass(className string) *ClassInfo {
+	if dbm == nil {
+		return nil
+	}
 	// fmt.Printf("GetClass: getting %s\n", className)
 	//	fmt.Printf("GetClass: map is %s\n", dbm.ClassMap)
 	return dbm.ClassMap[className]
 }
 
-func (dbm *DBMetadata) IsSubclass(className string, inclusive bool) (bool, error) {
-	// @todo implement
+// Return true if className is a subclass of parentClass. If inclusive is true, a class is also
+// considered a subclass of itself. Returns an error if className is not in the metadata.
+func (dbm *DBMetadata) IsSubclass(className string, parentClass string, inclusive bool) (bool, error) {
+	c := dbm.GetClass(className)
+	if c == nil {
+		return false, errors.New("Class '" + className + "' is not in the metadata")
+	}
+	for _, a := range c.Ancestors {
+		if a == parentClass && (inclusive || a != className) {
+			return true, nil
+		}
+	}
 	return false, nil
 }
 
+// Return the tables that hold the class' fields, from the base table down to the class' own table if
+// it has one. Returns an error if className is not in the metadata.
 func (dbm *DBMetadata) TablesForClass(className string) ([]string, error) {
-	var t = []string{"SiteTree"}
+	c := dbm.GetClass(className)
+	if c == nil {
+		return nil, errors.New("Class '" + className + "' is not in the metadata")
+	}
+	var t []string
+	for _, table := range c.tables {
+		t = append(t, table.TableName)
+	}
 	return t, nil
 }
@@ -0,0 +1,154 @@
+package orm
+
+import (
+	"github.com/mrmorphic/goss/data"
+	"reflect"
+	"sync"
+)
+
+// This file maps the fields of model structs to SilverStripe field names. By default a struct field
+// maps to the SilverStripe field of the same name. An "ss" tag maps it to a different name, and
+// `ss:"-"` excludes it:
+//
+//	type Page struct {
+//		control.DataObjectBase
+//		Segment  string `ss:"URLSegment"`
+//		Rendered string `ss:"-"`
+//	}
+//
+// Fields of embedded structs are promoted as they are in Go, so a field of the outer struct takes
+// precedence over an embedded field with the same name. Embedded pointers are not followed. The map
+// for each type is computed once, when the model is registered or first used.
+
+var (
+	modelFieldsLock sync.RWMutex
+
+	// Maps struct types to their field maps, which map SilverStripe field names to struct field indexes.
+	modelFieldCache = map[reflect.Type]map[string][]int{}
+)
+
+// Return the field map of a struct type, or of the struct type a pointer points to.
+func modelFields(t reflect.Type) map[string][]int {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	modelFieldsLock.RLock()
+	fields, ok := modelFieldCache[t]
+	modelFieldsLock.RUnlock()
+	if ok {
+		return fields
+	}
+
+	fields = typeFields(t)
+	modelFieldsLock.Lock()
+	modelFieldCache[t] = fields
+	modelFieldsLock.Unlock()
+	return fields
+}
+
+// Compute the field map of a struct type. Embedded structs are traversed breadth first, so that
+// shallower fields are found first and take precedence.
+func typeFields(t reflect.Type) map[string][]int {
+	fields := make(map[string][]int)
+	if t.Kind() != reflect.Struct {
+		return fields
+	}
+
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+	current := []embedded{{t, nil}}
+	visited := map[reflect.Type]bool{}
+
+	for len(current) > 0 {
+		var next []embedded
+		for _, s := range current {
+			if visited[s.t] {
+				continue
+			}
+			visited[s.t] = true
+
+			for i := 0; i < s.t.NumField(); i++ {
+				sf := s.t.Field(i)
+				tag := sf.Tag.Get("ss")
+				if tag == "-" {
+					continue
+				}
+
+				index := append(append([]int{}, s.index...), i)
+				if sf.Anonymous && tag == "" && sf.Type.Kind() == reflect.Struct {
+					next = append(next, embedded{sf.Type, index})
+					continue
+				}
+				if sf.PkgPath != "" {
+					// unexported
+					continue
+				}
+
+				name := sf.Name
+				if tag != "" {
+					name = tag
+				}
+				if _, exists := fields[name]; !exists {
+					fields[name] = index
+				}
+			}
+		}
+		current = next
+	}
+	return fields
+}
+
+// Get the value of a field of a struct or pointer to a struct by its SilverStripe name. The second
+// return value is false if the struct has no such field.
+func modelFieldValue(obj interface{}, name string) (interface{}, bool) {
+	v := reflect.Indirect(reflect.ValueOf(obj))
+	if v.Kind() != reflect.Struct {
+		return nil, false
+	}
+
+	index, ok := modelFields(v.Type())[name]
+	if !ok {
+		return nil, false
+	}
+	return v.FieldByIndex(index).Interface(), true
+}
+
+// Set a field of a pointer to a struct by its SilverStripe name. The value is converted to the
+// field's type if necessary, and nil sets the zero value. Returns false if the struct has no such
+// field or the value can't be converted.
+func setModelField(obj interface{}, name string, value interface{}) bool {
+	v := reflect.ValueOf(obj)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return false
+	}
+
+	index, ok := modelFields(v.Type())[name]
+	if !ok {
+		return false
+	}
+
+	f := v.Elem().FieldByIndex(index)
+	if value == nil {
+		f.Set(reflect.Zero(f.Type()))
+		return true
+	}
+
+	cv := reflect.ValueOf(data.ConvertToType(value, f.Type()))
+	if !cv.Type().AssignableTo(f.Type()) {
+		return false
+	}
+	f.Set(cv)
+	return true
+}
+
+// resolveField lets data.Eval, and hence templates, access struct fields by their SilverStripe
+// names where these differ from the Go names.
+func resolveField(context interface{}, name string, args ...interface{}) (interface{}, bool) {
+	if len(args) > 0 {
+		return nil, false
+	}
+	return modelFieldValue(context, name)
+}
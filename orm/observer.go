@@ -0,0 +1,110 @@
+package orm
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// QueryEvent describes a SQL statement executed by the ORM, and is passed to the query observer.
+type QueryEvent struct {
+	// Name of the database the statement was executed on.
+	Database string
+
+	// The statement and its arguments.
+	SQL  string
+	Args []interface{}
+
+	// How long the statement took. For queries that are read by the ORM, this is the time until the
+	// last row is read, so it includes the time taken to process each object when the rows are
+	// streamed, e.g. by Each.
+	Duration time.Duration
+
+	// The number of rows read by a query, or affected by a statement. This is -1 if it's not known,
+	// which is the case for queries executed with Query, as the caller reads the rows.
+	Rows int
+
+	// The error from the statement, if any.
+	Err error
+}
+
+// QueryObserver is a function that is called after each SQL statement executed by the ORM. It is
+// called on the go-routine that executed the statement, so should return quickly.
+type QueryObserver func(*QueryEvent)
+
+var (
+	queryObserverLock sync.RWMutex
+	queryObserver     QueryObserver = (&QueryLog{SlowThreshold: time.Second}).Observe
+)
+
+// SetQueryObserver replaces the function that is called after each SQL statement. nil stops
+// observation. The default is a QueryLog that logs errors, and statements taking more than a
+// second.
+func SetQueryObserver(o QueryObserver) {
+	queryObserverLock.Lock()
+	defer queryObserverLock.Unlock()
+	queryObserver = o
+}
+
+// Pass a statement executed on the database to the query observer.
+func (d *Database) observe(sql string, args []interface{}, start time.Time, rows int, e error) {
+	queryObserverLock.RLock()
+	o := queryObserver
+	queryObserverLock.RUnlock()
+	if o == nil {
+		return
+	}
+
+	name := ""
+	if d != nil {
+		name = d.Name
+	}
+	o(&QueryEvent{Database: name, SQL: sql, Args: args, Duration: time.Since(start), Rows: rows, Err: e})
+}
+
+// QueryLog is a query observer that writes structured logs. Statements that fail are logged as
+// errors, statements that take at least SlowThreshold as warnings, and others at debug level, or
+// info level if All is set. The arguments of statements are only logged if Args is set, as they can
+// hold passwords and personal details.
+type QueryLog struct {
+	// The logger to write to. If nil, the default slog logger is used.
+	Logger *slog.Logger
+
+	// Statements taking at least this long are logged as warnings. 0 means no statement is slow.
+	SlowThreshold time.Duration
+
+	// If true, all statements are logged at info level rather than debug level.
+	All bool
+
+	// If true, the arguments of statements are logged as well as the SQL.
+	Args bool
+}
+
+// Observe logs a statement. Pass this to SetQueryObserver.
+func (l *QueryLog) Observe(ev *QueryEvent) {
+	logger := l.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	attrs := []interface{}{
+		slog.String("database", ev.Database),
+		slog.String("sql", ev.SQL),
+		slog.Duration("duration", ev.Duration),
+		slog.Int("rows", ev.Rows),
+	}
+	if l.Args {
+		attrs = append(attrs, slog.Any("args", ev.Args))
+	}
+
+	switch {
+	case ev.Err != nil:
+		logger.Error("sql failed", append(attrs, slog.Any("error", ev.Err))...)
+	case l.SlowThreshold > 0 && ev.Duration >= l.SlowThreshold:
+		logger.Warn("slow sql", attrs...)
+	case l.All:
+		logger.Info("sql", attrs...)
+	default:
+		logger.Debug("sql", attrs...)
+	}
+}
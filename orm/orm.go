@@ -1,15 +1,11 @@
 package orm
 
 import (
+	"context"
 	"github.com/mrmorphic/goss"
 	"reflect"
 )
 
-// metadataSource is a path to the file containing metadata used by the ORM.
-var metadataSource string
-
-var dbMetadata *DBMetadata
-
 // A map of class names to DataObject instances which is used when we get objects
 // from the database.
 var models map[string]interface{}
@@ -24,32 +20,96 @@ type DataObject interface {
 // DataQuery is an interface for constructing queries. The interface is chainable, with many
 // methods returning a new or modified DataQuery object.
 type DataQuery interface {
-	// Where adds an object selection condition to a query. There are two forms allowable,
-	// one where
-	Where(interface{}) DataQuery
+	// Where adds an object selection condition to a query. The condition is raw SQL, and any values
+	// should be given as args, bound to "?" placeholders in the condition, e.g.
+	// Where("\"SiteTree\".\"URLSegment\"=?", segment)
+	Where(string, ...interface{}) DataQuery
+
+	// Filter restricts the query to objects that match all of the filters. Keys are field names with
+	// optional SilverStripe search filters and modifiers, e.g. "Title:PartialMatch:nocase". A slice
+	// value matches any of its values. Fields that aren't in the metadata are an error.
+	Filter(map[string]interface{}) DataQuery
+
+	// FilterAny restricts the query to objects that match any of the filters.
+	FilterAny(map[string]interface{}) DataQuery
+
+	// Exclude removes objects that match all of the filters.
+	Exclude(map[string]interface{}) DataQuery
 
 	// Sort specifies a sort order for query results. Sort takes one or more string parameters.
-	// Each parameter is a field name, optionally suffixed with a space and "asc" or "desc".
+	// Each parameter is a field name, optionally suffixed with a space and "asc" or "desc". A
+	// parameter may list several fields separated by commas. Unknown fields are an error.
 	Sort(string, ...string) DataQuery
 
+	// Reverse reverses the sort order.
+	Reverse() DataQuery
+
 	Limit(offset int, length int) DataQuery
 
+	// SetReadingMode determines whether the query reads the draft (Stage), published (Live) or archived
+	// versions of versioned classes. Queries read Live unless this is called.
+	SetReadingMode(ReadingMode) DataQuery
+
+	// With names relations that are loaded for all of the objects when the query is run, with one
+	// query per relation, rather than one per object when each is accessed. See DataQuerySQL.With.
+	With(relations ...string) DataQuery
+
+	// Count returns the number of objects the query matches, ignoring Limit.
+	Count() (int, error)
+
+	// Exists returns true if the query matches any objects.
+	Exists() (bool, error)
+
+	// Max, Min, Sum and Avg return the aggregate of a field over the objects the query matches,
+	// ignoring Limit.
+	Max(field string) (interface{}, error)
+	Min(field string) (interface{}, error)
+	Sum(field string) (float64, error)
+	Avg(field string) (float64, error)
+
+	// Each executes the query and calls fn with each object as it is read from the database, without
+	// holding the result set in memory. Iteration stops at the first error from fn, which is returned.
+	Each(fn func(interface{}) error) error
+
+	// EachContext is Each with a context. If the context is cancelled or its deadline passes, the
+	// query is cancelled and the context's error returned.
+	EachContext(ctx context.Context, fn func(interface{}) error) error
+
 	// Execute the query and return it's result. All error handling is returned via Run to
 	// simplify the signatures of chainable methods.
 	Run() (interface{}, error)
+
+	// RunContext is Run with a context, which cancels the query when it is done.
+	RunContext(ctx context.Context) (interface{}, error)
 }
 
+// IsHierarchical returns true if the class has the Hierarchy extension, directly or through an
+// ancestor.
 func IsHierarchical(className string) bool {
-	return dbMetadata.IsHierarchical(className)
+	return defaultDatabase().IsHierarchical(className)
+}
+
+// IsSubclass returns true if className is a subclass of parentClass, or if inclusive is true, is
+// parentClass.
+func IsSubclass(className string, parentClass string, inclusive bool) (bool, error) {
+	return defaultDatabase().IsSubclass(className, parentClass, inclusive)
+}
+
+// TableForMode returns the name of the table to read a class' data from in a reading mode, for use
+// in SQL that is not generated by a DataQuery. e.g. TableForMode("SiteTree", Live) is "SiteTree_Live".
+func TableForMode(className string, mode ReadingMode) string {
+	return defaultDatabase().TableForMode(className, mode)
 }
 
 // Register one or more model instances. The map key is the ClassName value returned in
 // a data object fetch, and the instance is an object that will be used as a prototype
-// for generating new DataObject instances.
+// for generating new DataObject instances. Struct fields are mapped to SilverStripe fields
+// by name, or by their "ss" tag; see model.go.
 func RegisterModels(m map[string]interface{}) {
 	// @todo make concurrency-safe.
 	for k, v := range m {
 		models[k] = v
+		modelFields(reflect.TypeOf(v))
 	}
 }
 
@@ -1 +1,1389 @@
 package orm
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMetadata sets up metadata for a small SiteTree hierarchy, which is used in place of a metadata file.
+func testMetadata() *DBMetadata {
+	dbm := &DBMetadata{
+		Classes: []*ClassInfo{
+			&ClassInfo{
+				ClassName:    "SiteTree",
+				HasTable:     true,
+				Versioned:    true,
+				TableName:    "SiteTree",
+				Ancestors:    []string{"SiteTree"},
+				Descendents:  []string{"Page", "BlogPage"},
+				Fields:       []*DBField{{"URLSegment", "Varchar"}, {"Title", "Varchar"}, {"ParentID", "ForeignKey"}},
+				Hierarchical: true,
+			},
+			&ClassInfo{
+				ClassName:   "Page",
+				HasTable:    true,
+				Versioned:   true,
+				TableName:   "Page",
+				Ancestors:   []string{"SiteTree", "Page"},
+				Descendents: []string{"BlogPage"},
+			},
+			&ClassInfo{
+				ClassName: "BlogPage",
+				HasTable:  true,
+				Versioned: true,
+				TableName: "BlogPage",
+				Ancestors: []string{"SiteTree", "Page", "BlogPage"},
+				Fields:    []*DBField{{"Date", "Date"}, {"AuthorID", "ForeignKey"}},
+				Relations: []*Relation{
+					{Name: "Author", Kind: HasOne, ClassName: "Member"},
+					{Name: "Tags", Kind: ManyMany, ClassName: "Tag", ExtraFields: []*DBField{{"SortOrder", "Int"}}},
+				},
+			},
+			&ClassInfo{
+				ClassName: "Member",
+				HasTable:  true,
+				TableName: "Member",
+				Ancestors: []string{"Member"},
+				Fields:    []*DBField{{"FirstName", "Varchar"}},
+				Relations: []*Relation{{Name: "Posts", Kind: HasMany, ClassName: "BlogPage"}},
+			},
+			&ClassInfo{
+				ClassName: "Tag",
+				HasTable:  true,
+				TableName: "Tag",
+				Ancestors: []string{"Tag"},
+				Fields:    []*DBField{{"Title", "Varchar"}},
+				Relations: []*Relation{{Name: "Pages", Kind: BelongsManyMany, ClassName: "BlogPage"}},
+			},
+		},
+	}
+	dbm.precache()
+	registerDatabase(&Database{Name: DefaultDatabase}).setMetadata(dbm)
+	return dbm
+}
+
+func TestSplitFields(t *testing.T) {
+	dbm := testMetadata()
+
+	obj := DataObjectMap{"ClassName": "BlogPage", "Title": "A post", "Date": "2013-01-01", "Created": "ignored"}
+	writes := splitFields(dbm.GetClass("BlogPage"), obj)
+
+	if len(writes) != 3 {
+		t.Fatalf("Expected writes to 3 tables, got %d", len(writes))
+	}
+
+	expected := []tableWrite{
+		{"SiteTree", []string{"Title"}, []interface{}{"A post"}},
+		{"Page", nil, nil},
+		{"BlogPage", []string{"Date"}, []interface{}{"2013-01-01"}},
+	}
+	for i, w := range writes {
+		if !reflect.DeepEqual(*w, expected[i]) {
+			t.Errorf("Expected write %v, got %v", expected[i], *w)
+		}
+	}
+}
+
+func TestWriteSQL(t *testing.T) {
+	s := insertSQL("SiteTree", []string{"Title", "ClassName"})
+	if s != `insert into "SiteTree" ("Title","ClassName") values (?,?)` {
+		t.Errorf("Unexpected insert SQL: %s", s)
+	}
+
+	s = updateSQL("SiteTree", []string{"Title", "ClassName"})
+	if s != `update "SiteTree" set "Title"=?,"ClassName"=? where "ID"=?` {
+		t.Errorf("Unexpected update SQL: %s", s)
+	}
+}
+
+func TestReadingModeSQL(t *testing.T) {
+	testMetadata()
+
+	s, _, e := NewQuery("Page").(*DataQuerySQL).sql()
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	expected := `select "BlogPage".*,"Page".*,"SiteTree".* from "SiteTree_Live" "SiteTree" inner join "Page_Live" "Page" on "SiteTree"."ID"="Page"."ID" ` +
+		`left join "BlogPage_Live" "BlogPage" on "Page"."ID"="BlogPage"."ID" ` +
+		`where "SiteTree"."ClassName" in (?,?)`
+	if s != expected {
+		t.Errorf("Unexpected live SQL:\n%s\nexpected:\n%s", s, expected)
+	}
+
+	s, _, _ = NewQuery("BlogPage").SetReadingMode(Stage).(*DataQuerySQL).sql()
+	expected = `select "BlogPage".*,"Page".*,"SiteTree".* from "SiteTree" "SiteTree" inner join "Page" "Page" on "SiteTree"."ID"="Page"."ID" ` +
+		`inner join "BlogPage" "BlogPage" on "Page"."ID"="BlogPage"."ID" ` +
+		`where "SiteTree"."ClassName" in (?)`
+	if s != expected {
+		t.Errorf("Unexpected stage SQL:\n%s\nexpected:\n%s", s, expected)
+	}
+
+	date := time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC)
+	s, args, _ := NewQuery("BlogPage").SetReadingMode(Archived(date)).(*DataQuerySQL).sql()
+	expected = `select "BlogPage".*,"Page".*,"SiteTree".*,"SiteTree"."RecordID" "ID" from "SiteTree_versions" "SiteTree" ` +
+		`inner join "Page_versions" "Page" on "SiteTree"."RecordID"="Page"."RecordID" and "SiteTree"."Version"="Page"."Version" ` +
+		`inner join "BlogPage_versions" "BlogPage" on "Page"."RecordID"="BlogPage"."RecordID" and "Page"."Version"="BlogPage"."Version" ` +
+		`where "SiteTree"."ClassName" in (?) and "SiteTree"."Version"=(select max("v"."Version") from "SiteTree_versions" "v" ` +
+		`where "v"."RecordID"="SiteTree"."RecordID" and "v"."LastEdited"<=?)`
+	if s != expected {
+		t.Errorf("Unexpected archive SQL:\n%s\nexpected:\n%s", s, expected)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"BlogPage", "2013-06-01 12:00:00"}) {
+		t.Errorf("Expected class and archive date arguments, got %v", args)
+	}
+}
+
+func TestAllVersionsSQL(t *testing.T) {
+	testMetadata()
+
+	q, e := AllVersionsOf("Page", 5)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	s, args, _ := q.(*DataQuerySQL).sql()
+	expected := `select "BlogPage".*,"Page".*,"SiteTree".*,"SiteTree"."RecordID" "ID" from "SiteTree_versions" "SiteTree" ` +
+		`inner join "Page_versions" "Page" on "SiteTree"."RecordID"="Page"."RecordID" and "SiteTree"."Version"="Page"."Version" ` +
+		`left join "BlogPage_versions" "BlogPage" on "Page"."RecordID"="BlogPage"."RecordID" and "Page"."Version"="BlogPage"."Version" ` +
+		`where "SiteTree"."ClassName" in (?,?) and "SiteTree"."RecordID"=? ` +
+		`order by "SiteTree"."Version" desc`
+	if s != expected {
+		t.Errorf("Unexpected versions SQL:\n%s\nexpected:\n%s", s, expected)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"Page", "BlogPage", 5}) {
+		t.Errorf("Expected class and ID arguments, got %v", args)
+	}
+}
+
+func TestDefaultWhere(t *testing.T) {
+	// namespaced class names have backslashes, and table names may need quoting
+	dbm := &DBMetadata{Classes: []*ClassInfo{
+		{ClassName: `App\Model\Item`, HasTable: true, TableName: `App"Item`, Ancestors: []string{`App\Model\Item`}, Descendents: []string{`App\Model\Special`}},
+		{ClassName: `App\Model\Special`, HasTable: false, TableName: `App"Item`, Ancestors: []string{`App\Model\Item`, `App\Model\Special`}},
+	}}
+	dbm.precache()
+
+	where, args := dbm.GetClass(`App\Model\Item`).where(Live)
+	if where != `"App""Item"."ClassName" in (?,?)` {
+		t.Errorf("Unexpected where clause %s", where)
+	}
+	if !reflect.DeepEqual(args, []interface{}{`App\Model\Item`, `App\Model\Special`}) {
+		t.Errorf("Expected class names to be bound, got %v", args)
+	}
+}
+
+func TestRelationKeys(t *testing.T) {
+	dbm := testMetadata()
+
+	expected := map[string]Relation{
+		"BlogPage.Author": {"Author", HasOne, "Member", "AuthorID", "", "", nil},
+		"BlogPage.Tags":   {"Tags", ManyMany, "Tag", "BlogPageID", "BlogPage_Tags", "TagID", nil},
+		"Member.Posts":    {"Posts", HasMany, "BlogPage", "AuthorID", "", "", nil},
+		"Tag.Pages":       {"Pages", BelongsManyMany, "BlogPage", "TagID", "BlogPage_Tags", "BlogPageID", nil},
+	}
+	for k, exp := range expected {
+		parts := strings.Split(k, ".")
+		r := dbm.GetClass(parts[0]).relation(parts[1])
+		if r == nil {
+			t.Errorf("Expected relation %s to exist", k)
+		} else if r.Name != exp.Name || r.Kind != exp.Kind || r.ClassName != exp.ClassName || r.ForeignKey != exp.ForeignKey ||
+			r.JoinTable != exp.JoinTable || r.LocalKey != exp.LocalKey {
+			t.Errorf("Relation %s expected to be %v, got %v", k, exp, *r)
+		}
+	}
+}
+
+func TestRelationSQL(t *testing.T) {
+	dbm := testMetadata()
+
+	tests := map[string]string{
+		"Member.Posts": `select "BlogPage".*,"Page".*,"SiteTree".* from "SiteTree_Live" "SiteTree" inner join "Page_Live" "Page" on "SiteTree"."ID"="Page"."ID" ` +
+			`inner join "BlogPage_Live" "BlogPage" on "Page"."ID"="BlogPage"."ID" ` +
+			`where "SiteTree"."ClassName" in (?) and "BlogPage"."AuthorID"=?`,
+		"BlogPage.Tags": `select "Tag".*,"BlogPage_Tags"."SortOrder" "SortOrder" from "Tag" "Tag" inner join "BlogPage_Tags" on "BlogPage_Tags"."TagID"="Tag"."ID" ` +
+			`where "Tag"."ClassName" in (?) and "BlogPage_Tags"."BlogPageID"=?`,
+	}
+	for k, expected := range tests {
+		parts := strings.Split(k, ".")
+		r := dbm.GetClass(parts[0]).relation(parts[1])
+		s, _, _ := relationQuery(defaultDatabase(), Live, dbm.GetClass(r.ClassName), r, 3).(*DataQuerySQL).sql()
+		if s != expected {
+			t.Errorf("Unexpected SQL for %s:\n%s\nexpected:\n%s", k, s, expected)
+		}
+	}
+}
+
+func TestFilterSQL(t *testing.T) {
+	testMetadata()
+
+	q := NewQuery("Page").Filter(map[string]interface{}{
+		"Title:PartialMatch:nocase": "news",
+		"ID":                        []int{1, 2, 3},
+	}).FilterAny(map[string]interface{}{
+		"Date:GreaterThan": "2013-01-01",
+		"ParentID":         nil,
+	}).Exclude(map[string]interface{}{
+		"URLSegment:StartsWith": "home",
+	}).(*DataQuerySQL)
+
+	s, args, e := q.sql()
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+
+	expected := `("SiteTree"."ID" in (?,?,?) and lower("SiteTree"."Title") like lower(?)) and ` +
+		`("BlogPage"."Date">? or "SiteTree"."ParentID" is null) and not ("SiteTree"."URLSegment" like ?)`
+	if !strings.HasSuffix(s, expected) {
+		t.Errorf("Unexpected filter SQL:\n%s\nexpected to end with:\n%s", s, expected)
+	}
+
+	expectedArgs := []interface{}{"Page", "BlogPage", 1, 2, 3, "%news%", "2013-01-01", "home%"}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Expected args %v, got %v", expectedArgs, args)
+	}
+
+	_, _, e = NewQuery("Page").Filter(map[string]interface{}{"Title:Bogus": "x"}).(*DataQuerySQL).sql()
+	if e == nil {
+		t.Errorf("Expected an error for an unknown search filter")
+	}
+
+	for _, key := range []string{`Title"=1 or 1=1 or "x`, "Bogus"} {
+		_, _, e = NewQuery("Page").Filter(map[string]interface{}{key: "x"}).(*DataQuerySQL).sql()
+		if e == nil || !strings.Contains(e.Error(), "has no field") {
+			t.Errorf("Expected an error for filter key %s, got %v", key, e)
+		}
+	}
+
+	if q := quoteIdentifier(`a"b`); q != `"a""b"` {
+		t.Errorf("Expected embedded quotes to be doubled, got %s", q)
+	}
+}
+
+func TestWhereArgs(t *testing.T) {
+	testMetadata()
+
+	q := NewQuery("Page").Where("\"SiteTree\".\"URLSegment\"=?", "about' or 1=1").Filter(map[string]interface{}{"ParentID": 2})
+	s, args, e := q.(*DataQuerySQL).sql()
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+
+	if !strings.HasSuffix(s, `and "SiteTree"."URLSegment"=? and ("SiteTree"."ParentID"=?)`) {
+		t.Errorf("Unexpected SQL: %s", s)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"Page", "BlogPage", "about' or 1=1", 2}) {
+		t.Errorf("Unexpected args: %v", args)
+	}
+}
+
+func TestAggregateSQL(t *testing.T) {
+	testMetadata()
+
+	q := NewQuery("BlogPage").Where("\"SiteTree\".\"ParentID\"=?", 4).Sort("\"Title\"").Limit(0, 10).(*DataQuerySQL)
+	column, e := q.fieldColumn(metadata().GetClass("BlogPage"), "Date")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	s, args, e := q.aggregateSQL("max(" + column + ")")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+
+	expected := `select max("BlogPage"."Date") from "SiteTree_Live" "SiteTree" inner join "Page_Live" "Page" on "SiteTree"."ID"="Page"."ID" ` +
+		`inner join "BlogPage_Live" "BlogPage" on "Page"."ID"="BlogPage"."ID" ` +
+		`where "SiteTree"."ClassName" in (?) and "SiteTree"."ParentID"=?`
+	if s != expected {
+		t.Errorf("Unexpected aggregate SQL:\n%s\nexpected:\n%s", s, expected)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"BlogPage", 4}) {
+		t.Errorf("Unexpected args: %v", args)
+	}
+
+	// fields are checked against the metadata before anything is sent to the database
+	db := recordingDatabase()
+	for _, field := range []string{`Title") from "Member" --`, "Bogus"} {
+		if _, e := db.NewQuery("BlogPage").Max(field); e == nil || !strings.Contains(e.Error(), "has no field") {
+			t.Errorf("Expected an error for field %q, got %v", field, e)
+		}
+		if _, e := db.NewQuery("BlogPage").Sum(field); e == nil {
+			t.Errorf("Expected an error summing field %q", field)
+		}
+	}
+	if queries := recorder.take(); len(queries) != 0 {
+		t.Errorf("Expected no queries for invalid fields, got %v", queries)
+	}
+}
+
+func TestSortSQL(t *testing.T) {
+	testMetadata()
+
+	orderBy := func(q DataQuery) string {
+		s, _, e := q.(*DataQuerySQL).sql()
+		if e != nil {
+			return "error: " + e.Error()
+		}
+		if i := strings.Index(s, " order by "); i >= 0 {
+			return s[i+len(" order by "):]
+		}
+		return ""
+	}
+
+	tests := map[string]struct {
+		q        DataQuery
+		expected string
+	}{
+		"single":              {NewQuery("BlogPage").Sort("Title"), `"SiteTree"."Title" asc`},
+		"multiple":            {NewQuery("BlogPage").Sort("Date DESC, Title", "ID"), `"BlogPage"."Date" desc,"SiteTree"."Title" asc,"SiteTree"."ID" asc`},
+		"direction":           {NewQuery("BlogPage").Sort("Title", "desc"), `"SiteTree"."Title" desc`},
+		"qualified":           {NewQuery("BlogPage").Sort(`"SiteTree"."Title" desc`), `"SiteTree"."Title" desc`},
+		"replaced":            {NewQuery("BlogPage").Sort("Title").Sort("Date"), `"BlogPage"."Date" asc`},
+		"reverse":             {NewQuery("BlogPage").Sort("Date desc", "Title").Reverse(), `"BlogPage"."Date" asc,"SiteTree"."Title" desc`},
+		"reverse ID":          {NewQuery("BlogPage").Reverse(), `"SiteTree"."ID" desc`},
+		"list":                {NewDataList(NewQuery("BlogPage")).Sort("Title").Reverse().(*DataListStruct).query, `"SiteTree"."Title" desc`},
+		"hierarchy":           {NewQuery("BlogPage").Sort("Sort"), `"SiteTree"."Sort" asc`},
+		"not hierarchical":    {NewQuery("Member").Sort("Sort"), `error: Class 'Member' has no field 'Sort' to sort by`},
+		"unknown":             {NewQuery("BlogPage").Sort("Nonsense"), `error: Class 'BlogPage' has no field 'Nonsense' to sort by`},
+		"wrong table":         {NewQuery("BlogPage").Sort(`"Page"."Title"`), `error: Class 'BlogPage' has no field '"Page"."Title"' to sort by`},
+		"direction injection": {NewQuery("BlogPage").Sort("Title; drop table Member"), `error: Invalid sort clause 'Title; drop table Member'`},
+		"field injection":     {NewQuery("BlogPage").Sort(`(select(sleep(5)))`), `error: Invalid sort field '(select(sleep(5)))'`},
+		"quote injection":     {NewQuery("BlogPage").Sort(`"SiteTree"."Title"||sleep(5)||""`), `error: Invalid sort field '"SiteTree"."Title"||sleep(5)||""'`},
+	}
+
+	for name, test := range tests {
+		if s := orderBy(test.q); s != test.expected {
+			t.Errorf("%s: expected order by %s, got %s", name, test.expected, s)
+		}
+	}
+
+	// a table without field metadata only has the system fields
+	bare := &ClassInfo{ClassName: "Bare", TableName: "Bare"}
+	bare.tables = []*ClassInfo{bare}
+	if bare.hasField("Title") || !bare.hasField("ID") {
+		t.Errorf("Expected only system fields for a class without field metadata")
+	}
+}
+
+func TestDataListEach(t *testing.T) {
+	testMetadata()
+
+	set := NewDataList(NewQuery("Page"))
+	for i := 1; i <= 3; i++ {
+		set.Append(DataObjectMap{"ID": i})
+	}
+
+	var ids []interface{}
+	stop := errors.New("stop")
+	e := set.Each(func(obj interface{}) error {
+		ids = append(ids, obj.(DataObjectMap)["ID"])
+		if len(ids) == 2 {
+			return stop
+		}
+		return nil
+	})
+
+	if e != stop {
+		t.Errorf("Expected Each to return the error from fn, got %v", e)
+	}
+	if !reflect.DeepEqual(ids, []interface{}{1, 2}) {
+		t.Errorf("Expected Each to stop after the second item, got %v", ids)
+	}
+}
+
+type testBase struct {
+	ID        int
+	ClassName string
+	Title     string
+}
+
+type testModel struct {
+	testBase
+	Title    string
+	Segment  string `ss:"URLSegment"`
+	Rendered string `ss:"-"`
+	Sort     int
+	hidden   string
+}
+
+func TestModelFields(t *testing.T) {
+	fields := modelFields(reflect.TypeOf(&testModel{}))
+	expected := map[string][]int{
+		"ID":         {0, 0},
+		"ClassName":  {0, 1},
+		"Title":      {1},
+		"URLSegment": {2},
+		"Sort":       {4},
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Unexpected field map %v", fields)
+	}
+
+	m := &testModel{}
+	setField(m, "ID", int64(3))
+	setField(m, "URLSegment", "about-us")
+	setField(m, "Sort", "2")
+	setField(m, "Rendered", "ignored")
+	setField(m, "Unknown", "ignored")
+	if m.ID != 3 || m.Segment != "about-us" || m.Sort != 2 || m.Rendered != "" {
+		t.Errorf("Fields not set as expected: %v", m)
+	}
+
+	if v, ok := fieldValue(m, "URLSegment"); !ok || v != "about-us" {
+		t.Errorf("Expected URLSegment from tagged field, got %v", v)
+	}
+	if _, ok := fieldValue(m, "Segment"); ok {
+		t.Errorf("Expected tagged field not to be found by its Go name")
+	}
+}
+
+func TestConvertColumn(t *testing.T) {
+	date := time.Date(2013, 5, 1, 14, 30, 0, 0, time.Local)
+	tests := []struct {
+		ssType   string
+		raw      interface{}
+		expected interface{}
+	}{
+		{"Int", int64(42), 42},
+		{"Int", []byte("42"), 42},
+		{"ForeignKey", nil, 0},
+		{"Boolean", int64(1), true},
+		{"Boolean", []byte("0"), false},
+		{"Boolean", nil, false},
+		{"Decimal(9,2)", []byte("12.50"), 12.5},
+		{"Currency", float64(3), float64(3)},
+		{"SS_Datetime", []byte("2013-05-01 14:30:00"), date},
+		{"Date", []byte("2013-05-01"), time.Date(2013, 5, 1, 0, 0, 0, 0, time.Local)},
+		{"Date", []byte("0000-00-00"), time.Time{}},
+		{"SS_Datetime", date, date},
+		{"Varchar(255)", []byte("Title"), "Title"},
+		{"HTMLText", nil, ""},
+		{"Enum('A,B','A')", []byte("B"), "B"},
+		{"", int64(7), "7"},
+	}
+
+	for _, test := range tests {
+		v, e := convertColumn(test.ssType, test.raw)
+		if e != nil {
+			t.Errorf("%s %v: unexpected error %s", test.ssType, test.raw, e)
+			continue
+		}
+		if !reflect.DeepEqual(v, test.expected) {
+			t.Errorf("%s %v: expected %#v, got %#v", test.ssType, test.raw, test.expected, v)
+		}
+	}
+
+	if _, e := convertColumn("Int", []byte("abc")); e == nil {
+		t.Errorf("Expected an error converting a non-numeric Int")
+	}
+
+	ci := testMetadata().GetClass("Page")
+	for column, expected := range map[string]string{"ID": "Int", "Title": "Varchar", "Date": "Date", "Other": ""} {
+		if ci.columnType(column) != expected {
+			t.Errorf("Expected column %s of Page to have type %s, got %s", column, expected, ci.columnType(column))
+		}
+	}
+}
+
+func TestIntrospectedClasses(t *testing.T) {
+	tables := map[string]*schemaTable{
+		"SiteTree": {"SiteTree", []schemaColumn{
+			{"ID", "int(11)"}, {"ClassName", "enum('SiteTree','Page','BlogPage','ErrorPage')"},
+			{"Title", "varchar(255)"}, {"ShowInMenus", "tinyint(1) unsigned"}, {"ParentID", "int(11)"}, {"Content", "mediumtext"},
+		}},
+		"SiteTree_Live":     {"SiteTree_Live", nil},
+		"SiteTree_versions": {"SiteTree_versions", nil},
+		"Page":              {"Page", []schemaColumn{{"ID", "int(11)"}}},
+		"BlogPage":          {"BlogPage", []schemaColumn{{"ID", "int(11)"}, {"Date", "date"}, {"Rating", "decimal(9,2)"}}},
+	}
+
+	classes := baseTableClasses(tables["SiteTree"])
+	if !reflect.DeepEqual(classes, []string{"SiteTree", "Page", "BlogPage", "ErrorPage"}) {
+		t.Fatalf("Unexpected ClassName values %v", classes)
+	}
+	if baseTableClasses(tables["Page"]) != nil {
+		t.Errorf("Expected Page not to be a base table")
+	}
+
+	counts := map[string]int{"Page": 5, "BlogPage": 2}
+	ancestors := map[string][]string{
+		"SiteTree": {"SiteTree"},
+		"Page":     orderAncestors("SiteTree", []string{"Page"}, counts, classes),
+		"BlogPage": orderAncestors("SiteTree", []string{"BlogPage", "Page"}, counts, classes),
+	}
+	dbm := &DBMetadata{Classes: hierarchyClasses(classes, ancestors, tables)}
+	dbm.precache()
+
+	blog := dbm.GetClass("BlogPage")
+	if !reflect.DeepEqual(blog.Ancestors, []string{"SiteTree", "Page", "BlogPage"}) || !blog.Versioned || !blog.HasTable {
+		t.Errorf("Unexpected BlogPage %v", blog)
+	}
+	if blog.columnType("Date") != "Date" || blog.columnType("Rating") != "Decimal" {
+		t.Errorf("Unexpected BlogPage fields %v", blog.columnTypes)
+	}
+
+	// ErrorPage has no records or table, so its only known ancestor is the base class
+	if e := dbm.GetClass("ErrorPage"); !reflect.DeepEqual(e.Ancestors, []string{"SiteTree", "ErrorPage"}) || e.HasTable {
+		t.Errorf("Unexpected ErrorPage %v", e)
+	}
+
+	// inferred ancestry may be missing classes, so subclasses can't be written
+	if _, e := classInfoOf(dbm, DataObjectMap{"ClassName": "BlogPage"}); e == nil || !blog.InferredAncestry {
+		t.Errorf("Expected writing a class with inferred ancestry to fail")
+	}
+	if _, e := classInfoOf(dbm, DataObjectMap{"ClassName": "SiteTree"}); e != nil {
+		t.Errorf("Unexpected error writing a base class: %s", e)
+	}
+
+	st := dbm.GetClass("SiteTree")
+	if !reflect.DeepEqual(st.Descendents, []string{"Page", "BlogPage", "ErrorPage"}) {
+		t.Errorf("Unexpected SiteTree descendents %v", st.Descendents)
+	}
+	types := map[string]string{}
+	for _, f := range st.Fields {
+		types[f.Name] = f.SSType
+	}
+	if !reflect.DeepEqual(types, map[string]string{"Title": "Varchar", "ShowInMenus": "Boolean", "ParentID": "ForeignKey", "Content": "Text"}) {
+		t.Errorf("Unexpected SiteTree fields %v", types)
+	}
+
+	// the written JSON must read back as the same classes
+	var b bytes.Buffer
+	if e := dbm.WriteJSON(&b); e != nil {
+		t.Fatal(e.Error())
+	}
+	read := &DBMetadata{}
+	if e := json.Unmarshal(b.Bytes(), read); e != nil {
+		t.Fatal(e.Error())
+	}
+	read.precache()
+	if !reflect.DeepEqual(read.GetClass("BlogPage").Ancestors, blog.Ancestors) || len(read.Classes) != 4 {
+		t.Errorf("Unexpected metadata read back from JSON: %s", b.String())
+	}
+
+	// only SiteTree is known to have the Hierarchy extension; others are marked by configuration
+	tables["File"] = &schemaTable{"File", []schemaColumn{{"ID", "int(11)"}, {"ClassName", "enum('File','Folder')"}, {"ParentID", "int(11)"}}}
+	files := hierarchyClasses(baseTableClasses(tables["File"]), map[string][]string{}, tables)
+	dbm = &DBMetadata{Classes: append(dbm.Classes, files...)}
+	dbm.precache()
+	if !dbm.IsHierarchical("BlogPage") || dbm.IsHierarchical("File") {
+		t.Errorf("Expected only the SiteTree hierarchy to be hierarchical")
+	}
+	if e := markHierarchical(dbm, []interface{}{"File"}); e != nil || !dbm.IsHierarchical("Folder") {
+		t.Errorf("Expected File and its subclasses to be marked hierarchical, got %v", e)
+	}
+	if e := markHierarchical(dbm, []interface{}{"Nonsense"}); e == nil {
+		t.Errorf("Expected an error marking an unknown class hierarchical")
+	}
+
+	if _, e := IntrospectMetadata(nil, PostgreSQL); e == nil || !strings.Contains(e.Error(), "only generate metadata from the schema of MySQL") {
+		t.Errorf("Expected an error introspecting a PostgreSQL database, got %v", e)
+	}
+}
+
+func TestRefreshOnDemand(t *testing.T) {
+	f, e := ioutil.TempFile("", "metadata")
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer os.Remove(f.Name())
+
+	if e = testMetadata().WriteJSON(f); e != nil {
+		t.Fatal(e.Error())
+	}
+	f.Close()
+
+	first, e := (*DBMetadata)(nil).RefreshOnDemand(f.Name())
+	if e != nil || first.GetClass("BlogPage") == nil {
+		t.Fatalf("Expected metadata to be read, got %v, %v", first, e)
+	}
+
+	if same, _ := first.RefreshOnDemand(f.Name()); same != first {
+		t.Errorf("Expected unchanged metadata file not to be reread")
+	}
+
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(f.Name(), later, later)
+	changed, e := first.RefreshOnDemand(f.Name())
+	if e != nil || changed == first || changed.GetClass("BlogPage") == nil {
+		t.Errorf("Expected changed metadata file to be reread into new metadata, got %v, %v", changed, e)
+	}
+}
+
+func TestClassAncestry(t *testing.T) {
+	dbm := testMetadata()
+
+	for className, expected := range map[string]bool{"SiteTree": true, "BlogPage": true, "Member": false, "Unknown": false} {
+		if dbm.IsHierarchical(className) != expected {
+			t.Errorf("Expected IsHierarchical(%s) to be %v", className, expected)
+		}
+	}
+
+	subclassTests := []struct {
+		className, parent string
+		inclusive         bool
+		expected          bool
+	}{
+		{"BlogPage", "SiteTree", false, true},
+		{"BlogPage", "Page", false, true},
+		{"Page", "BlogPage", false, false},
+		{"Page", "Page", false, false},
+		{"Page", "Page", true, true},
+		{"Member", "SiteTree", true, false},
+	}
+	for _, test := range subclassTests {
+		if is, e := dbm.IsSubclass(test.className, test.parent, test.inclusive); e != nil || is != test.expected {
+			t.Errorf("Expected IsSubclass(%s, %s, %v) to be %v, got %v, %v", test.className, test.parent, test.inclusive, test.expected, is, e)
+		}
+	}
+	if _, e := dbm.IsSubclass("Unknown", "SiteTree", true); e == nil {
+		t.Errorf("Expected an error for an unknown class")
+	}
+
+	tables, e := dbm.TablesForClass("BlogPage")
+	if e != nil || !reflect.DeepEqual(tables, []string{"SiteTree", "Page", "BlogPage"}) {
+		t.Errorf("Unexpected tables for BlogPage %v, %v", tables, e)
+	}
+}
+
+type testDatabaseModel struct {
+	ID        int
+	ClassName string
+	db        *Database
+}
+
+func (m *testDatabaseModel) SetDatabase(db *Database) { m.db = db }
+func (m *testDatabaseModel) Database() *Database      { return m.db }
+
+func TestDatabaseBinding(t *testing.T) {
+	testMetadata()
+	other := registerDatabase(&Database{Name: "other"})
+	other.setMetadata(&DBMetadata{Classes: []*ClassInfo{
+		{ClassName: "Member", HasTable: true, TableName: "Member", Ancestors: []string{"Member"}},
+	}})
+	other.Metadata().precache()
+	defer func() {
+		databasesLock.Lock()
+		delete(databases, "other")
+		databasesLock.Unlock()
+	}()
+
+	if GetDatabase("other") != other {
+		t.Errorf("Expected GetDatabase to return the registered database")
+	}
+	if _, _, e := other.NewQuery("BlogPage").(*DataQuerySQL).sql(); e == nil {
+		t.Errorf("Expected a query on the other database to use its metadata")
+	}
+	if _, _, e := NewQuery("BlogPage").(*DataQuerySQL).sql(); e != nil {
+		t.Errorf("Expected a query on the default database to use its metadata, got %s", e)
+	}
+	if _, _, e := (*Database)(nil).NewQuery("Member").(*DataQuerySQL).sql(); e != errNoDatabase {
+		t.Errorf("Expected a query on a missing database to fail, got %v", e)
+	}
+
+	obj := &testDatabaseModel{ClassName: "Member"}
+	if databaseOf(obj) != defaultDatabase() {
+		t.Errorf("Expected an object without a database to use the default database")
+	}
+	obj.SetDatabase(other)
+	if databaseOf(obj) != other {
+		t.Errorf("Expected an object to use the database it was read from")
+	}
+}
+
+func TestDialects(t *testing.T) {
+	limits := map[Dialect]string{MySQL: "limit 20, 10", PostgreSQL: "limit 10 offset 20", SQLite: "limit 10 offset 20"}
+	for d, expected := range limits {
+		if s := d.Limit(20, 10); s != expected {
+			t.Errorf("Expected %s limit '%s', got '%s'", d.Name(), expected, s)
+		}
+	}
+
+	s := PostgreSQL.Rebind(`select * from "Odd?" where "Title"=? and "Content" like '%?%' and "ID" in (?,?)`)
+	expected := `select * from "Odd?" where "Title"=$1 and "Content" like '%?%' and "ID" in ($2,$3)`
+	if s != expected {
+		t.Errorf("Expected rebound SQL '%s', got '%s'", expected, s)
+	}
+
+	for name, expected := range map[string]Dialect{"mysql": MySQL, "postgres": PostgreSQL, "sqlite3": SQLite, "sqlite": SQLite, "oracle": nil} {
+		if DialectFor(name) != expected {
+			t.Errorf("Unexpected dialect for driver %s", name)
+		}
+	}
+
+	dsn := withDSNParam("user:pass@/db?parseTime=true", "sql_mode", "'ANSI'")
+	if dsn != "user:pass@/db?parseTime=true&sql_mode=%27ANSI%27" {
+		t.Errorf("Unexpected data source %s", dsn)
+	}
+	if withDSNParam("user:pass@/db?sql_mode=TRADITIONAL", "sql_mode", "'ANSI'") != "user:pass@/db?sql_mode=TRADITIONAL" {
+		t.Errorf("Expected data source parameter not to be replaced")
+	}
+
+	// MySQL's sql_mode must make double quotes quote identifiers
+	for dsn, ok := range map[string]bool{
+		"user:pass@/db": true,
+		"user:pass@/db?parseTime=true&sql_mode=%27ANSI%27":     true,
+		"user:pass@/db?sql_mode=%27TRADITIONAL,ansi_quotes%27": true,
+		"user:pass@/db?sql_mode=TRADITIONAL":                   false,
+		"user:pass@/db?sql_mode=%27%27":                        false,
+	} {
+		if _, e := MySQL.Open("goss_recording", dsn); (e == nil) != ok {
+			t.Errorf("Unexpected result opening %s: %v", dsn, e)
+		}
+	}
+
+	testMetadata()
+	sqlite := registerDatabase(&Database{Name: "sqlite", dialect: SQLite})
+	sqlite.setMetadata(metadata())
+	defer func() {
+		databasesLock.Lock()
+		delete(databases, "sqlite")
+		databasesLock.Unlock()
+	}()
+
+	q := sqlite.NewQuery("Member").Filter(map[string]interface{}{"FirstName:case": "Sam"}).Limit(5, 5).(*DataQuerySQL)
+	s, _, e := q.sql()
+	if e != nil {
+		t.Fatalf("Unexpected error %s", e)
+	}
+	if !strings.HasSuffix(s, ` and ("Member"."FirstName" collate binary=?) limit 5 offset 5`) {
+		t.Errorf("Unexpected SQLite query %s", s)
+	}
+
+	f, _ := parseFilterKey("ShowInMenus")
+	cond, args, _ := f.condition(PostgreSQL, `"SiteTree"."ShowInMenus"`, true)
+	if cond != `"SiteTree"."ShowInMenus"=1` || len(args) != 0 {
+		t.Errorf("Unexpected boolean condition %s %v", cond, args)
+	}
+}
+
+// recordingDriver is a database/sql driver that records the statements it is given, so the statements
+// goss executes can be tested without a database server. "select count" queries return 0, other
+// queries return no rows, and inserts return an ID of 7.
+type recordingDriver struct {
+	sync.Mutex
+	statements []string
+
+	// If set, returns the columns and rows for a query. Otherwise, counts are 0 and other queries
+	// return no rows.
+	results func(query string) ([]string, [][]driver.Value)
+
+	// If set, statements affect no rows, rather than one.
+	affectNone bool
+
+	// The context of the last query.
+	context context.Context
+}
+
+var recorder = &recordingDriver{}
+
+func init() {
+	sql.Register("goss_recording", recorder)
+}
+
+func (r *recordingDriver) record(s string) {
+	r.Lock()
+	defer r.Unlock()
+	r.statements = append(r.statements, s)
+}
+
+// Return the statements recorded since the last call.
+func (r *recordingDriver) take() []string {
+	r.Lock()
+	defer r.Unlock()
+	result := r.statements
+	r.statements = nil
+	return result
+}
+
+func (r *recordingDriver) Open(name string) (driver.Conn, error) { return recordingConn{}, nil }
+
+type recordingConn struct{}
+
+func (recordingConn) Prepare(query string) (driver.Stmt, error) { return recordingStmt(query), nil }
+func (recordingConn) Close() error                              { return nil }
+func (recordingConn) Begin() (driver.Tx, error) {
+	recorder.record("begin")
+	return recordingConn{}, nil
+}
+func (recordingConn) Commit() error   { recorder.record("commit"); return nil }
+func (recordingConn) Rollback() error { recorder.record("rollback"); return nil }
+
+type recordingStmt string
+
+func (s recordingStmt) Close() error  { return nil }
+func (s recordingStmt) NumInput() int { return -1 }
+func (s recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	recorder.record(string(s))
+	recorder.Lock()
+	defer recorder.Unlock()
+	if recorder.affectNone {
+		return driver.RowsAffected(0), nil
+	}
+	return driver.RowsAffected(1), nil
+}
+func (s recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	recorder.record(string(s))
+	recorder.Lock()
+	results := recorder.results
+	recorder.Unlock()
+	if results != nil {
+		cols, rows := results(string(s))
+		return &recordingRows{cols: cols, rows: rows}, nil
+	}
+	if strings.HasPrefix(string(s), "select count") {
+		return &recordingRows{cols: []string{"n"}, rows: [][]driver.Value{{int64(0)}}}, nil
+	}
+	return &recordingRows{cols: []string{"n"}}, nil
+}
+
+func (s recordingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	recorder.Lock()
+	recorder.context = ctx
+	recorder.Unlock()
+	var values []driver.Value
+	for _, a := range args {
+		values = append(values, a.Value)
+	}
+	return s.Query(values)
+}
+
+type recordingRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *recordingRows) Columns() []string { return r.cols }
+func (r *recordingRows) Close() error      { return nil }
+func (r *recordingRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// recordingInsert is a dialect whose inserts return the ID 7, which the recording driver can't.
+type recordingInsert struct {
+	sqliteDialect
+}
+
+func (recordingInsert) Insert(ctx context.Context, tx *sql.Tx, sql string, args ...interface{}) (int64, error) {
+	_, e := tx.Exec(sql, args...)
+	return 7, e
+}
+
+func recordingDatabase() *Database {
+	db, _ := sql.Open("goss_recording", "")
+	d := &Database{Name: "recording", db: db, dialect: recordingInsert{}}
+	d.setMetadata(testMetadata())
+	recorder.take()
+	return d
+}
+
+func TestTransaction(t *testing.T) {
+	d := recordingDatabase()
+	failed := errors.New("failed")
+
+	e := d.Transaction(func(tx *Tx) error {
+		tx.Exec("update 1")
+		if e := tx.Transaction(func(tx *Tx) error {
+			tx.Exec("update 2")
+			return failed
+		}); e != failed {
+			t.Errorf("Expected the nested transaction's error, got %v", e)
+		}
+		return tx.Transaction(func(tx *Tx) error {
+			_, e := tx.Exec("update 3")
+			return e
+		})
+	})
+	if e != nil {
+		t.Errorf("Unexpected error %s", e)
+	}
+	expected := []string{"begin", "update 1", `savepoint "goss_1"`, "update 2", `rollback to savepoint "goss_1"`,
+		`savepoint "goss_1"`, "update 3", `release savepoint "goss_1"`, "commit"}
+	if s := recorder.take(); !reflect.DeepEqual(s, expected) {
+		t.Errorf("Expected statements %v, got %v", expected, s)
+	}
+
+	if e := d.Transaction(func(tx *Tx) error { return failed }); e != failed {
+		t.Errorf("Expected the transaction's error, got %v", e)
+	}
+	if s := recorder.take(); !reflect.DeepEqual(s, []string{"begin", "rollback"}) {
+		t.Errorf("Expected failed transaction to roll back, got %v", s)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected the panic to continue")
+			}
+		}()
+		d.Transaction(func(tx *Tx) error { panic("failed") })
+	}()
+	if s := recorder.take(); !reflect.DeepEqual(s, []string{"begin", "rollback"}) {
+		t.Errorf("Expected panicking transaction to roll back, got %v", s)
+	}
+
+	obj := DataObjectMap{"ClassName": "BlogPage", "Title": "A post"}
+	e = d.Transaction(func(tx *Tx) error {
+		if e := tx.Write(obj); e != nil {
+			return e
+		}
+		_, e := tx.NewQuery("BlogPage").(*DataQuerySQL).Count()
+		return e
+	})
+	s := recorder.take()
+	if e != nil || obj["ID"] != 7 || len(s) != 11 || s[0] != "begin" || s[10] != "commit" ||
+		!strings.HasPrefix(s[1], `insert into "SiteTree"`) || !strings.HasPrefix(s[9], "select count(*)") {
+		t.Errorf("Expected write and query in one transaction, got %v, %v", s, e)
+	}
+}
+
+func TestMapDatabase(t *testing.T) {
+	d := recordingDatabase()
+	recorder.Lock()
+	recorder.results = func(query string) ([]string, [][]driver.Value) {
+		return []string{"ID", "ClassName", "FirstName"}, [][]driver.Value{{int64(5), "Member", "Sam"}}
+	}
+	recorder.Unlock()
+	defer func() {
+		recorder.Lock()
+		recorder.results = nil
+		recorder.Unlock()
+	}()
+
+	item, e := firstItem(d.NewQuery("Member"))
+	if e != nil {
+		t.Fatalf("Unexpected error %s", e)
+	}
+	if m, ok := item.(DataObjectMap); !ok || m.Database() != d || databaseOf(m) != d {
+		t.Fatalf("Expected the map to hold the database it was read from, got %v", item)
+	}
+	recorder.take()
+
+	// Write uses the map's database, not the default database
+	item.(DataObjectMap)["FirstName"] = "Alex"
+	if e = Write(item); e != nil {
+		t.Fatalf("Unexpected error %s", e)
+	}
+	if s := recorder.take(); len(s) < 2 || !strings.HasPrefix(s[1], `update "Member"`) {
+		t.Errorf("Expected the map to be written to its database, got %v", s)
+	}
+}
+
+func TestRelationReadingMode(t *testing.T) {
+	d := recordingDatabase()
+	recorder.Lock()
+	recorder.results = func(query string) ([]string, [][]driver.Value) {
+		return []string{"ID", "ClassName", "FirstName"}, [][]driver.Value{{int64(5), "Member", "Sam"}}
+	}
+	recorder.Unlock()
+	defer func() {
+		recorder.Lock()
+		recorder.results = nil
+		recorder.Unlock()
+	}()
+
+	tests := []struct {
+		mode     ReadingMode
+		expected string
+	}{
+		{Live, `from "SiteTree_Live" "SiteTree"`},
+		{Stage, `from "SiteTree" "SiteTree"`},
+		{AllVersions, `from "SiteTree" "SiteTree"`},
+		{Archived(time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC)), `from "SiteTree_versions" "SiteTree"`},
+	}
+	for _, test := range tests {
+		item, e := firstItem(d.NewQuery("Member").SetReadingMode(test.mode))
+		if e != nil {
+			t.Fatalf("Unexpected error %s", e)
+		}
+		posts, e := GetRelation(item, "Posts")
+		if e != nil {
+			t.Fatalf("Unexpected error %s", e)
+		}
+		s, _, _ := posts.(*DataListStruct).query.(*DataQuerySQL).sql()
+		if !strings.Contains(s, test.expected) {
+			t.Errorf("Expected relation of an object read in %s to read %s, got:\n%s", test.mode, test.expected, s)
+		}
+	}
+	recorder.take()
+}
+
+func TestWriteVersioned(t *testing.T) {
+	d := recordingDatabase()
+	recorder.Lock()
+	recorder.results = func(query string) ([]string, [][]driver.Value) {
+		return []string{"n"}, [][]driver.Value{{int64(3)}}
+	}
+	recorder.Unlock()
+	defer func() {
+		recorder.Lock()
+		recorder.results = nil
+		recorder.affectNone = false
+		recorder.Unlock()
+	}()
+
+	obj := DataObjectMap{"ClassName": "BlogPage", "ID": 7, "Title": "A post", "Version": 1}
+	if e := d.Write(obj); e != nil {
+		t.Fatalf("Unexpected error %s", e)
+	}
+	if obj["Version"] != 4 {
+		t.Errorf("Expected the version after the latest to be written, got %v", obj["Version"])
+	}
+
+	var versions []string
+	for _, s := range recorder.take() {
+		if strings.Contains(s, `_versions" ("RecordID","Version"`) {
+			versions = append(versions, s)
+		}
+	}
+	expected := `insert into "BlogPage_versions" ("RecordID","Version","Date","AuthorID") select "ID",?,"Date","AuthorID" from "BlogPage" where "ID"=?`
+	if len(versions) != 3 || versions[2] != expected {
+		t.Errorf("Expected a version row in each table, got %v", versions)
+	}
+
+	// updating an object that isn't in the database doesn't write the other tables
+	recorder.Lock()
+	recorder.results = func(query string) ([]string, [][]driver.Value) {
+		return []string{"n"}, [][]driver.Value{{int64(0)}}
+	}
+	recorder.affectNone = true
+	recorder.Unlock()
+	e := d.Write(DataObjectMap{"ClassName": "BlogPage", "ID": 8, "Title": "Missing"})
+	if e == nil || e.Error() != "Cannot write BlogPage 8, which is not in the database" {
+		t.Errorf("Expected an error writing a missing object, got %v", e)
+	}
+	if s := recorder.take(); len(s) != 5 || !strings.HasPrefix(s[2], `update "SiteTree"`) || s[4] != "rollback" {
+		t.Errorf("Expected the write to stop at the base table, got %v", s)
+	}
+}
+
+func TestContext(t *testing.T) {
+	d := recordingDatabase()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, e := d.NewQuery("Member").RunContext(ctx); e != context.Canceled {
+		t.Errorf("Expected a cancelled query, got %v", e)
+	}
+	e := NewDataList(d.NewQuery("Member")).EachContext(ctx, func(interface{}) error { return nil })
+	if e != context.Canceled {
+		t.Errorf("Expected a cancelled list, got %v", e)
+	}
+	if e := d.TransactionContext(ctx, func(tx *Tx) error { return nil }); e != context.Canceled {
+		t.Errorf("Expected a cancelled transaction, got %v", e)
+	}
+	if s := recorder.take(); len(s) != 0 {
+		t.Errorf("Expected nothing to be executed, got %v", s)
+	}
+
+	if _, e := d.NewQuery("Member").RunContext(context.Background()); e != nil {
+		t.Errorf("Unexpected error %s", e)
+	}
+	if s := recorder.take(); len(s) != 1 {
+		t.Errorf("Expected the query to be executed, got %v", s)
+	}
+}
+
+func TestQueryObserver(t *testing.T) {
+	var events []*QueryEvent
+	SetQueryObserver(func(ev *QueryEvent) { events = append(events, ev) })
+	defer SetQueryObserver((&QueryLog{SlowThreshold: time.Second}).Observe)
+
+	d := recordingDatabase()
+	d.NewQuery("Member").Run()
+	d.NewQuery("Member").(*DataQuerySQL).Count()
+	d.Exec("update \"Member\" set \"FirstName\"=?", "Sam")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.QueryContext(ctx, "select 1")
+
+	expected := []struct {
+		prefix string
+		rows   int
+		err    error
+	}{
+		{"select \"Member\".*", 0, nil},
+		{"select count(*)", 1, nil},
+		{"update \"Member\"", 1, nil},
+		{"select 1", -1, context.Canceled},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(events))
+	}
+	for i, ev := range events {
+		if ev.Database != "recording" || !strings.HasPrefix(ev.SQL, expected[i].prefix) || ev.Rows != expected[i].rows || ev.Err != expected[i].err {
+			t.Errorf("Unexpected event %+v", ev)
+		}
+	}
+	if !reflect.DeepEqual(events[2].Args, []interface{}{"Sam"}) {
+		t.Errorf("Expected args of statement, got %v", events[2].Args)
+	}
+
+	var buf bytes.Buffer
+	l := &QueryLog{Logger: slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})), SlowThreshold: time.Second}
+	levels := map[*QueryEvent]string{
+		&QueryEvent{SQL: "select 1", Duration: time.Millisecond}:                        "level=DEBUG",
+		&QueryEvent{SQL: "select 1", Duration: 2 * time.Second}:                         "level=WARN",
+		&QueryEvent{SQL: "select 1", Duration: 2 * time.Second, Err: errors.New("bad")}: "level=ERROR",
+	}
+	for ev, level := range levels {
+		buf.Reset()
+		l.Observe(ev)
+		if !strings.Contains(buf.String(), level) || !strings.Contains(buf.String(), `sql="select 1"`) {
+			t.Errorf("Expected %s log, got %s", level, buf.String())
+		}
+	}
+
+	// arguments are only logged when asked for
+	ev := &QueryEvent{SQL: "select 1", Args: []interface{}{"secret"}, Err: errors.New("bad")}
+	buf.Reset()
+	l.Observe(ev)
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("Expected arguments to be left out, got %s", buf.String())
+	}
+	l.Args = true
+	buf.Reset()
+	l.Observe(ev)
+	if !strings.Contains(buf.String(), "args=[secret]") {
+		t.Errorf("Expected arguments to be logged, got %s", buf.String())
+	}
+}
+
+func TestEagerLoading(t *testing.T) {
+	d := recordingDatabase()
+	recorder.Lock()
+	recorder.results = func(query string) ([]string, [][]driver.Value) {
+		switch {
+		case strings.Contains(query, `"Member"`):
+			return []string{"ID", "ClassName", "FirstName", relationKeyColumn}, [][]driver.Value{{int64(5), "Member", "Sam", int64(5)}}
+		case strings.Contains(query, `"BlogPage_Tags"`):
+			return []string{"ID", "ClassName", "Title", "SortOrder", relationKeyColumn}, [][]driver.Value{
+				{int64(10), "Tag", "go", int64(1), int64(1)},
+				{int64(11), "Tag", "sql", int64(2), int64(1)},
+				{int64(10), "Tag", "go", int64(1), int64(2)},
+			}
+		}
+		return []string{"ID", "ClassName", "Title", "AuthorID"}, [][]driver.Value{
+			{int64(1), "BlogPage", "First", int64(5)},
+			{int64(2), "BlogPage", "Second", int64(5)},
+			{int64(3), "BlogPage", "Third", int64(0)},
+		}
+	}
+	recorder.Unlock()
+	defer func() {
+		recorder.Lock()
+		recorder.results = nil
+		recorder.Unlock()
+	}()
+
+	res, e := d.NewQuery("BlogPage").With("Author", "Tags").Run()
+	if e != nil {
+		t.Fatalf("Unexpected error %s", e)
+	}
+	items, _ := res.(DataList).Items()
+	if len(items) != 3 {
+		t.Fatalf("Expected 3 posts, got %d", len(items))
+	}
+
+	statements := recorder.take()
+	if len(statements) != 3 {
+		t.Fatalf("Expected a query for the posts and one per relation, got %v", statements)
+	}
+	if !strings.HasSuffix(statements[1], `and "Member"."ID" in (?)`) || !strings.Contains(statements[1], `"Member"."ID" "goss_RelationKey"`) {
+		t.Errorf("Unexpected has_one query %s", statements[1])
+	}
+	if !strings.HasSuffix(statements[2], `and "BlogPage_Tags"."BlogPageID" in (?,?,?)`) {
+		t.Errorf("Unexpected many_many query %s", statements[2])
+	}
+
+	for i, post := range items {
+		author, e := GetRelation(post, "Author")
+		if name, _ := fieldValue(author, "FirstName"); i < 2 && (e != nil || name != "Sam") {
+			t.Errorf("Expected author of post %d to be loaded, got %v, %v", i, author, e)
+		}
+		if i == 2 && author != nil {
+			t.Errorf("Expected post without author to have none, got %v", author)
+		}
+		if _, ok := fieldValue(author, relationKeyColumn); ok {
+			t.Errorf("Expected relation key not to be set on the author")
+		}
+	}
+
+	tags, _ := items[0].(DataObjectMap).Get("Tags").(*ManyManyList).Items()
+	if len(tags) != 2 || intField(tags[1], "SortOrder") != 2 {
+		t.Errorf("Expected 2 tags with extra fields on the first post, got %v", tags)
+	}
+	tags, _ = items[1].(DataObjectMap).Get("Tags").(*ManyManyList).Items()
+	if len(tags) != 1 {
+		t.Errorf("Expected 1 tag on the second post, got %v", tags)
+	}
+	tags, _ = items[2].(DataObjectMap).Get("Tags").(*ManyManyList).Items()
+	if tags == nil || len(tags) != 0 {
+		t.Errorf("Expected no tags on the third post, got %v", tags)
+	}
+
+	if s := recorder.take(); len(s) != 0 {
+		t.Errorf("Expected loaded relations not to be queried, got %v", s)
+	}
+
+	// changing the query of a loaded relation queries again, leaving the loaded list as it was
+	loaded := items[0].(DataObjectMap).Get("Tags").(*ManyManyList)
+	sorted, e := loaded.Sort("Title", "desc").(DataList).Items()
+	if e != nil {
+		t.Fatalf("Unexpected error %s", e)
+	}
+	statements = recorder.take()
+	if len(statements) != 1 || !strings.HasSuffix(statements[0], `order by "Tag"."Title" desc`) {
+		t.Errorf("Expected the sorted relation to be queried, got %v", statements)
+	}
+	if len(sorted) != 3 {
+		t.Errorf("Expected the items of the sorted query, got %v", sorted)
+	}
+	if tags, _ := loaded.Items(); len(tags) != 2 {
+		t.Errorf("Expected the loaded relation to be unchanged, got %v", tags)
+	}
+	if _, e = loaded.Items(); e != nil || len(recorder.take()) != 0 {
+		t.Errorf("Expected the loaded relation not to be queried again")
+	}
+
+	if _, e := d.NewQuery("BlogPage").With("Comments").Run(); e == nil || e.Error() != "Class 'BlogPage' has no relation 'Comments'" {
+		t.Errorf("Expected error for unknown relation, got %v", e)
+	}
+}
+
+func TestEagerLoadingReadingMode(t *testing.T) {
+	d := recordingDatabase()
+	recorder.Lock()
+	recorder.results = func(query string) ([]string, [][]driver.Value) {
+		if strings.Contains(query, `"BlogPage"`) {
+			return []string{"ID", "ClassName", "Title", "AuthorID", relationKeyColumn}, [][]driver.Value{{int64(1), "BlogPage", "First", int64(5), int64(5)}}
+		}
+		return []string{"ID", "ClassName", "FirstName"}, [][]driver.Value{{int64(5), "Member", "Sam"}}
+	}
+	recorder.Unlock()
+	defer func() {
+		recorder.Lock()
+		recorder.results = nil
+		recorder.Unlock()
+	}()
+
+	tests := []struct {
+		mode     ReadingMode
+		expected string
+	}{
+		{Stage, `from "SiteTree" "SiteTree"`},
+		{Archived(time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC)), `from "SiteTree_versions" "SiteTree"`},
+	}
+	for _, test := range tests {
+		res, e := d.NewQuery("Member").SetReadingMode(test.mode).With("Posts").Run()
+		if e != nil {
+			t.Fatalf("Unexpected error %s", e)
+		}
+		items, _ := res.(DataList).Items()
+		statements := recorder.take()
+		if len(statements) != 2 || !strings.Contains(statements[1], test.expected) {
+			t.Errorf("Expected posts loaded in %s to read %s, got %v", test.mode, test.expected, statements)
+		}
+
+		posts := items[0].(DataObjectMap).Get("Posts").(*DataListStruct)
+		if s, _, _ := posts.query.(*DataQuerySQL).sql(); !strings.Contains(s, test.expected) {
+			t.Errorf("Expected the loaded list in %s to read %s, got:\n%s", test.mode, test.expected, s)
+		}
+		if loaded, _ := posts.Items(); len(loaded) != 1 || relationModeOf(loaded[0]) != test.mode {
+			t.Errorf("Expected the loaded posts to be read in %s, got %v", test.mode, loaded)
+		}
+	}
+}
+
+func TestDataListContext(t *testing.T) {
+	type key string
+	ctx := context.WithValue(context.Background(), key("request"), "a request")
+
+	// whether the last query was run in ctx
+	queriedInContext := func() bool {
+		recorder.Lock()
+		defer recorder.Unlock()
+		result := recorder.context != nil && recorder.context.Value(key("request")) == "a request"
+		recorder.context = nil
+		return result
+	}
+
+	d := recordingDatabase()
+	e := d.TransactionContext(ctx, func(tx *Tx) error {
+		if _, e := NewDataList(tx.NewQuery("Member")).Items(); e != nil || !queriedInContext() {
+			t.Errorf("Expected the list to be fetched in the transaction's context, got %v", e)
+		}
+		e := NewDataList(tx.NewQuery("Member")).Each(func(interface{}) error { return nil })
+		if e != nil || !queriedInContext() {
+			t.Errorf("Expected the list to be streamed in the transaction's context, got %v", e)
+		}
+		return nil
+	})
+	if e != nil {
+		t.Errorf("Unexpected error %s", e)
+	}
+	recorder.take()
+}
+
+func TestGroupedList(t *testing.T) {
+	list := NewDataList(nil)
+	for _, p := range []DataObjectMap{
+		{"Title": "a", "Category": "news"},
+		{"Title": "b", "Category": "events"},
+		{"Title": "c", "Category": "news"},
+		{"Title": "d"},
+	} {
+		list.Append(p)
+	}
+
+	l, e := NewGroupedList(list)
+	if e != nil {
+		t.Fatalf("Unexpected error %s", e)
+	}
+	groups := l.GroupedBy("Category")
+	expected := []struct {
+		key    interface{}
+		titles []string
+	}{
+		{"news", []string{"a", "c"}},
+		{"events", []string{"b"}},
+		{nil, []string{"d"}},
+	}
+	if len(groups) != len(expected) {
+		t.Fatalf("Expected %d groups, got %d", len(expected), len(groups))
+	}
+	for i, g := range groups {
+		var titles []string
+		for _, item := range g.Children {
+			titles = append(titles, item.(DataObjectMap)["Title"].(string))
+		}
+		if g.Key != expected[i].key || !reflect.DeepEqual(titles, expected[i].titles) {
+			t.Errorf("Expected group %v with %v, got %v with %v", expected[i].key, expected[i].titles, g.Key, titles)
+		}
+	}
+	if v, ok := resolveGroupKey(groups[0], "Category"); !ok || v != "news" {
+		t.Errorf("Expected the key to be available by the field name, got %v", v)
+	}
+
+	if l, e := NewGroupedList([]string{"x", "y"}); e != nil || l.Count() != 2 {
+		t.Errorf("Expected a GroupedList of a slice, got %v, %v", l, e)
+	}
+	if _, e := NewGroupedList(3); e == nil {
+		t.Errorf("Expected an error for a list that isn't a slice")
+	}
+}
@@ -0,0 +1,99 @@
+package orm
+
+import (
+	"time"
+)
+
+// ReadingMode determines which version of versioned DataObjects a query reads, in the same way as
+// SilverStripe's Versioned extension. Queries on classes that are not versioned are unaffected.
+type ReadingMode struct {
+	stage string
+
+	// for archived mode, the date at which we want to see the data.
+	date time.Time
+}
+
+var (
+	// Stage reads the draft content, from the base tables.
+	Stage = ReadingMode{stage: "Stage"}
+
+	// Live reads the published content, from the _Live tables. This is the default.
+	Live = ReadingMode{stage: "Live"}
+
+	// AllVersions reads every version of objects from the _versions tables, rather than just the
+	// latest. It is generally used with a condition on RecordID to get the history of one object.
+	AllVersions = ReadingMode{stage: "Versions"}
+)
+
+// Archived returns a reading mode that reads objects as they were at the given date, from the _versions
+// tables.
+func Archived(date time.Time) ReadingMode {
+	return ReadingMode{stage: "Archive", date: date}
+}
+
+// The reading mode used by queries unless SetReadingMode is called.
+var defaultReadingMode = Live
+
+func (m ReadingMode) IsArchived() bool {
+	return m.stage == "Archive"
+}
+
+// Determine if the mode reads from the _versions tables.
+func (m ReadingMode) readsVersions() bool {
+	return m.stage == "Archive" || m.stage == "Versions"
+}
+
+func (m ReadingMode) String() string {
+	if m.IsArchived() {
+		return m.stage + "." + m.date.Format(datetimeFormat)
+	}
+	return m.stage
+}
+
+// Return the suffix appended to the table name of a versioned class for this mode.
+func (m ReadingMode) suffix() string {
+	switch m.stage {
+	case "Live":
+		return "_Live"
+	case "Archive", "Versions":
+		return "_versions"
+	}
+	return ""
+}
+
+// Return the condition for joining two of a class' tables in this mode. In the _versions tables, ID
+// identifies the version row, so we join on the record and version instead.
+func (m ReadingMode) joinCondition(left string, right string) string {
+	l := quoteIdentifier(left)
+	r := quoteIdentifier(right)
+	if m.readsVersions() {
+		return l + ".\"RecordID\"=" + r + ".\"RecordID\" and " + l + ".\"Version\"=" + r + ".\"Version\""
+	}
+	return l + ".\"ID\"=" + r + ".\"ID\""
+}
+
+// ReadingModeObject is implemented by models that keep track of the reading mode of the query they were
+// read by, so that their relations are read in the same mode. Objects read by a query are given its
+// mode; other objects read relations in the default mode. control.DataObjectBase implements this.
+type ReadingModeObject interface {
+	SetReadingMode(ReadingMode)
+	ReadingMode() ReadingMode
+}
+
+// Return the reading mode to read the relations of obj in, which is the mode obj was read in.
+func relationModeOf(obj interface{}) ReadingMode {
+	if o, ok := obj.(ReadingModeObject); ok && o.ReadingMode().stage != "" {
+		return relationMode(o.ReadingMode())
+	}
+	return defaultReadingMode
+}
+
+// Return the reading mode to read the relations of objects read in mode. Objects read in archived mode
+// see their related objects as they were at the same date. A version read in AllVersions mode doesn't
+// identify the versions of its related objects, so they are read from the stage.
+func relationMode(mode ReadingMode) ReadingMode {
+	if mode == AllVersions {
+		return Stage
+	}
+	return mode
+}
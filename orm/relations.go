@@ -0,0 +1,302 @@
+package orm
+
+import (
+	"errors"
+	"github.com/mrmorphic/goss/convert"
+	"github.com/mrmorphic/goss/data"
+	"log/slog"
+)
+
+// Kinds of relation, as named in SilverStripe's config.
+const (
+	HasOne          = "has_one"
+	HasMany         = "has_many"
+	ManyMany        = "many_many"
+	BelongsManyMany = "belongs_many_many"
+)
+
+// Relation describes a relation declared by a class. These are read from the metadata file. Where the
+// key and join table names are omitted, they are derived using SilverStripe's conventions.
+type Relation struct {
+	// Name of the relation, e.g. "Author"
+	Name string
+
+	// One of HasOne, HasMany, ManyMany or BelongsManyMany
+	Kind string
+
+	// The class at the other end of the relation
+	ClassName string
+
+	// For has_one, the field of the owning class that holds the related ID (e.g. "AuthorID"). For
+	// has_many, the field of the related class that refers back to the owner. For many_many and
+	// belongs_many_many, the field of the join table that refers to the owner.
+	ForeignKey string
+
+	// For many_many and belongs_many_many, the join table, and its field that refers to the related
+	// object.
+	JoinTable string
+	LocalKey  string
+
+	// For many_many and belongs_many_many, additional fields on the join table, as declared by
+	// many_many_extraFields.
+	ExtraFields []*DBField
+}
+
+// Work out the relations available to the class, including those inherited from ancestors. Missing
+// keys and join tables are filled in by convention. This must be called after all classes are in
+// the class map.
+func (ci *ClassInfo) precacheRelations(dbm *DBMetadata) {
+	ci.relations = make(map[string]*Relation)
+	for _, c := range ci.Ancestors {
+		a := dbm.GetClass(c)
+		if a == nil {
+			continue
+		}
+		for _, r := range a.Relations {
+			a.deriveRelationKeys(dbm, r)
+			ci.relations[r.Name] = r
+		}
+	}
+}
+
+func (ci *ClassInfo) deriveRelationKeys(dbm *DBMetadata, r *Relation) {
+	switch r.Kind {
+	case HasOne:
+		if r.ForeignKey == "" {
+			r.ForeignKey = r.Name + "ID"
+		}
+	case HasMany:
+		if r.ForeignKey == "" {
+			// find the has_one on the related class that points back to this class
+			if back := dbm.findInverse(r.ClassName, HasOne, ci); back != nil {
+				r.ForeignKey = back.Name + "ID"
+			} else {
+				r.ForeignKey = ci.ClassName + "ID"
+			}
+		}
+	case ManyMany:
+		if r.JoinTable == "" {
+			r.JoinTable = ci.ClassName + "_" + r.Name
+		}
+		if r.ForeignKey == "" {
+			r.ForeignKey = ci.ClassName + "ID"
+		}
+		if r.LocalKey == "" {
+			r.LocalKey = r.ClassName + "ID"
+			if r.ClassName == ci.ClassName {
+				r.LocalKey = "ChildID"
+			}
+		}
+	case BelongsManyMany:
+		// the join is defined by the many_many on the other side, with the keys swapped.
+		if r.JoinTable == "" {
+			if mm := dbm.findInverse(r.ClassName, ManyMany, ci); mm != nil {
+				dbm.GetClass(mm.owner).deriveRelationKeys(dbm, mm.Relation)
+				r.JoinTable = mm.JoinTable
+				r.ForeignKey = mm.LocalKey
+				r.LocalKey = mm.ForeignKey
+				r.ExtraFields = mm.ExtraFields
+			}
+		}
+	}
+}
+
+// ownedRelation is a relation along with the name of the class that declares it.
+type ownedRelation struct {
+	*Relation
+	owner string
+}
+
+// Find a relation of the given kind declared on className or its ancestors that refers to target or
+// one of target's ancestors.
+func (dbm *DBMetadata) findInverse(className string, kind string, target *ClassInfo) *ownedRelation {
+	c := dbm.GetClass(className)
+	if c == nil {
+		return nil
+	}
+	for _, a := range c.Ancestors {
+		ac := dbm.GetClass(a)
+		if ac == nil {
+			continue
+		}
+		for _, r := range ac.Relations {
+			if r.Kind != kind {
+				continue
+			}
+			for _, t := range target.Ancestors {
+				if r.ClassName == t {
+					return &ownedRelation{r, ac.ClassName}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Return the relation of the given name on this class or its ancestors, or nil if there isn't one.
+func (ci *ClassInfo) relation(name string) *Relation {
+	return ci.relations[name]
+}
+
+// Return the quoted, table qualified reference to a field of the class. The table is the one of the
+// class' ancestors or descendents that declares the field, or the base table if none do.
+func (ci *ClassInfo) columnRef(field string) string {
+	table := ""
+	if t := ci.fieldTable(field); t != nil {
+		table = t.TableName
+	} else if ci.baseClass() != nil {
+		table = ci.baseClass().TableName
+	}
+	return quoteIdentifier(table) + "." + quoteIdentifier(field)
+}
+
+// Return the qualified column holding the ID of the class' records in mode. In the _versions tables ID
+// identifies the version, and the record is identified by RecordID.
+func (ci *ClassInfo) idRef(mode ReadingMode) string {
+	if ci.Versioned && mode.readsVersions() {
+		return quoteIdentifier(ci.baseClass().TableName) + ".\"RecordID\""
+	}
+	return ci.columnRef("ID")
+}
+
+// Return the class of the class' ancestors or descendents that declares field, or nil if none do.
+func (ci *ClassInfo) fieldTable(field string) *ClassInfo {
+	for _, tables := range [][]*ClassInfo{ci.tables, ci.descendentTables} {
+		for _, t := range tables {
+			for _, f := range t.Fields {
+				if f.Name == field {
+					return t
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Columns that hierarchical classes such as SiteTree always have, which are allowed even if the
+// metadata doesn't list them.
+var hierarchyFields = map[string]bool{"ParentID": true, "Sort": true}
+
+// Return true if field is a column of the class' tables. Fields the metadata doesn't list are unknown,
+// so metadata without fields only allows the system fields.
+func (ci *ClassInfo) hasField(field string) bool {
+	if systemFields[field] || (ci.Versioned && field == "Version") {
+		return true
+	}
+	if base := ci.baseClass(); base != nil && base.Hierarchical && hierarchyFields[field] {
+		return true
+	}
+	return ci.fieldTable(field) != nil
+}
+
+// Return true if table is one of the tables queried for the class.
+func (ci *ClassInfo) hasTable(table string) bool {
+	for _, tables := range [][]*ClassInfo{ci.tables, ci.descendentTables} {
+		for _, t := range tables {
+			if t.TableName == table {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetRelation returns the value of the named relation of obj, which must have ClassName and ID
+// fields. For has_one the result is the related object, or nil if there is none. For the other
+// relation kinds, the result is a DataList which is fetched when its items are requested. The
+// related objects are read from obj's database, in the reading mode of the query obj was read by.
+// If the relation was loaded with DataQuery.With and obj is a RelationHolder, the loaded value is
+// returned without querying.
+func GetRelation(obj interface{}, name string) (interface{}, error) {
+	if h, ok := obj.(RelationHolder); ok {
+		if v, ok := h.LoadedRelation(name); ok {
+			return v, nil
+		}
+	}
+
+	db := databaseOf(obj)
+	mode := relationModeOf(obj)
+	dbm := db.Metadata()
+	v, _ := fieldValue(obj, "ClassName")
+	className, _ := v.(string)
+	ci := dbm.GetClass(className)
+	if ci == nil {
+		return nil, errors.New("Class '" + className + "' is not in the metadata")
+	}
+
+	r := ci.relation(name)
+	if r == nil {
+		return nil, errors.New("Class '" + className + "' has no relation '" + name + "'")
+	}
+
+	related := dbm.GetClass(r.ClassName)
+	if related == nil || related.baseClass() == nil {
+		return nil, errors.New("Class '" + r.ClassName + "' is not in the metadata")
+	}
+
+	if r.Kind == HasOne {
+		v, _ := fieldValue(obj, r.ForeignKey)
+		id, e := convert.AsInt(v)
+		if e != nil || id == 0 {
+			return nil, e
+		}
+		return firstItem(db.NewQuery(r.ClassName).SetReadingMode(mode).Where(related.idRef(mode)+"=?", id))
+	}
+
+	v, _ = fieldValue(obj, "ID")
+	id, e := convert.AsInt(v)
+	if e != nil {
+		return nil, e
+	}
+	if r.Kind == HasMany {
+		return NewDataList(relationQuery(db, mode, related, r, id)), nil
+	}
+	return newManyManyList(db, mode, related, r, id), nil
+}
+
+// Generate the query for the objects of a has_many, many_many or belongs_many_many relation of the
+// object with the given ID, read in mode. For many_many, the extra fields of the join table are
+// selected too.
+func relationQuery(db *Database, mode ReadingMode, related *ClassInfo, r *Relation, id int) DataQuery {
+	q := db.NewQuery(r.ClassName).SetReadingMode(mode).(*DataQuerySQL)
+	return q.Where(joinRelation(q, related, r)+"=?", id)
+}
+
+// Set up q, a query on the related class of a has_many, many_many or belongs_many_many relation, to
+// read related objects, and return the column that refers to their owner. For many_many, this joins
+// the join table and selects its extra fields.
+func joinRelation(q *DataQuerySQL, related *ClassInfo, r *Relation) string {
+	if r.Kind == HasMany {
+		return related.columnRef(r.ForeignKey)
+	}
+
+	join := quoteIdentifier(r.JoinTable)
+	q.InnerJoin(r.JoinTable, join+"."+quoteIdentifier(r.LocalKey)+"="+related.idRef(q.mode))
+	q.extraTypes = make(map[string]string)
+	for _, f := range r.ExtraFields {
+		q.SelectExtraField(f.Name, join+"."+quoteIdentifier(f.Name))
+		q.extraTypes[f.Name] = f.SSType
+	}
+	return join + "." + quoteIdentifier(r.ForeignKey)
+}
+
+// resolveRelation lets data.Eval, and hence templates, access relations of maps and structs by name.
+func resolveRelation(context interface{}, name string, args ...interface{}) (interface{}, bool) {
+	v, _ := fieldValue(context, "ClassName")
+	className, _ := v.(string)
+	ci := databaseOf(context).Metadata().GetClass(className)
+	if ci == nil || ci.relation(name) == nil {
+		return nil, false
+	}
+
+	result, e := GetRelation(context, name)
+	if e != nil {
+		slog.Error("could not get relation", slog.String("relation", name), slog.Any("error", e))
+	}
+	return result, true
+}
+
+func init() {
+	data.RegisterResolver(resolveField)
+	data.RegisterResolver(resolveRelation)
+}
@@ -0,0 +1,150 @@
+package orm
+
+import (
+	"errors"
+	"strings"
+)
+
+// Sorting of DataQuery results. Sort accepts SilverStripe style sort clauses: each argument is a field
+// name optionally followed by "asc" or "desc", several fields may be separated by commas, and a
+// direction may be given as an argument on its own, e.g. Sort("Title"), Sort("Title desc, Created"),
+// Sort("Title", "desc"). Fields can be qualified with a table name, quoted or not, such as
+// "SiteTree"."Sort" or the extra fields of a many_many join table. Table and field names may only
+// contain letters, digits and underscores, and fields must be listed in the metadata, so a sort clause
+// can't be used to inject SQL.
+
+// sortTerm is one column of the order by clause.
+type sortTerm struct {
+	// quoted, table qualified column
+	column string
+	desc   bool
+}
+
+func (t sortTerm) String() string {
+	if t.desc {
+		return t.column + " desc"
+	}
+	return t.column + " asc"
+}
+
+// Sort sets the order of the query's results, replacing any previous order. Errors in the sort
+// clause are returned when the query is run.
+func (q *DataQuerySQL) Sort(clause string, rest ...string) DataQuery {
+	terms, e := q.parseSort(append([]string{clause}, rest...))
+	if e != nil {
+		if q.err == nil {
+			q.err = e
+		}
+		return q
+	}
+	q.orderBy = terms
+	return q
+}
+
+// Reverse reverses the direction of each field of the sort order. If no order has been set, the
+// results are sorted by descending ID.
+func (q *DataQuerySQL) Reverse() DataQuery {
+	if len(q.orderBy) == 0 {
+		ci := q.metadata().GetClass(q.baseClass)
+		if ci == nil {
+			if q.err == nil {
+				q.err = errors.New("Class '" + q.baseClass + "' is not in the metadata")
+			}
+			return q
+		}
+		q.orderBy = []sortTerm{{column: ci.columnRef("ID")}}
+	}
+
+	for i := range q.orderBy {
+		q.orderBy[i].desc = !q.orderBy[i].desc
+	}
+	return q
+}
+
+func (q *DataQuerySQL) parseSort(clauses []string) ([]sortTerm, error) {
+	ci := q.metadata().GetClass(q.baseClass)
+	if ci == nil {
+		return nil, errors.New("Class '" + q.baseClass + "' is not in the metadata")
+	}
+
+	var terms []sortTerm
+	for _, clause := range clauses {
+		for _, part := range strings.Split(clause, ",") {
+			words := strings.Fields(part)
+			switch {
+			case len(words) == 0:
+				continue
+			case len(words) == 1 && isSortDirection(words[0]) && len(terms) > 0:
+				// direction given on its own applies to the preceding field
+				terms[len(terms)-1].desc = strings.EqualFold(words[0], "desc")
+				continue
+			case len(words) > 2 || (len(words) == 2 && !isSortDirection(words[1])):
+				return nil, errors.New("Invalid sort clause '" + strings.TrimSpace(part) + "'")
+			}
+
+			column, e := q.sortColumn(ci, words[0])
+			if e != nil {
+				return nil, e
+			}
+			terms = append(terms, sortTerm{column: column, desc: len(words) == 2 && strings.EqualFold(words[1], "desc")})
+		}
+	}
+	return terms, nil
+}
+
+func isSortDirection(s string) bool {
+	return strings.EqualFold(s, "asc") || strings.EqualFold(s, "desc")
+}
+
+// Return the qualified column for a field in a sort clause, which may be qualified with a table.
+// The field must be a field of the class' tables, or an extra field or column of a joined table.
+func (q *DataQuerySQL) sortColumn(ci *ClassInfo, ref string) (string, error) {
+	parts := strings.Split(ref, ".")
+	for i, p := range parts {
+		if len(p) > 2 && ((p[0] == '"' && p[len(p)-1] == '"') || (p[0] == '`' && p[len(p)-1] == '`')) {
+			p = p[1 : len(p)-1]
+		}
+		if !isIdentifier(p) {
+			return "", errors.New("Invalid sort field '" + ref + "'")
+		}
+		parts[i] = p
+	}
+
+	switch len(parts) {
+	case 1:
+		if column, ok := q.extraFields[parts[0]]; ok {
+			return column, nil
+		}
+		if ci.hasField(parts[0]) {
+			return ci.columnRef(parts[0]), nil
+		}
+	case 2:
+		table, field := parts[0], parts[1]
+		column := quoteIdentifier(table) + "." + quoteIdentifier(field)
+		for _, j := range q.joinTables {
+			if j == table {
+				return column, nil
+			}
+		}
+		if ci.hasTable(table) && ci.hasField(field) {
+			// a field declared by one of the tables must be qualified with that table
+			if t := ci.fieldTable(field); t == nil || t.TableName == table {
+				return column, nil
+			}
+		}
+	}
+	return "", errors.New("Class '" + ci.ClassName + "' has no field '" + ref + "' to sort by")
+}
+
+// Return true if s is a plain identifier of letters, digits and underscores.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+//go:build sqlite
+// +build sqlite
+
+package orm
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mrmorphic/goss/data"
+	"testing"
+)
+
+// These tests run queries and writes against an in-memory SQLite database, so they don't need a
+// database server. They need cgo for the driver, and are run with:
+//
+//	go test -tags sqlite ./orm
+
+var sqliteSchema = []string{
+	`create table "SiteTree" ("ID" integer primary key autoincrement, "ClassName" varchar(50), "Created" datetime, "LastEdited" datetime, "URLSegment" varchar(255), "Title" varchar(255), "ParentID" integer not null default 0, "Version" integer not null default 0)`,
+	`create table "Page" ("ID" integer primary key)`,
+	`create table "BlogPage" ("ID" integer primary key, "Date" date, "AuthorID" integer not null default 0)`,
+	`create table "SiteTree_versions" ("ID" integer primary key autoincrement, "RecordID" integer, "Version" integer, "ClassName" varchar(50), "Created" datetime, "LastEdited" datetime, "URLSegment" varchar(255), "Title" varchar(255), "ParentID" integer not null default 0)`,
+	`create table "Page_versions" ("ID" integer primary key autoincrement, "RecordID" integer, "Version" integer)`,
+	`create table "BlogPage_versions" ("ID" integer primary key autoincrement, "RecordID" integer, "Version" integer, "Date" date, "AuthorID" integer not null default 0)`,
+	`create table "Member" ("ID" integer primary key autoincrement, "ClassName" varchar(50), "Created" datetime, "LastEdited" datetime, "FirstName" varchar(50))`,
+}
+
+func sqliteDatabase(t *testing.T) *Database {
+	d := &Database{Name: "sqlite", dialect: SQLite}
+	var e error
+	d.db, e = SQLite.Open("sqlite3", ":memory:")
+	if e != nil {
+		t.Fatalf("Could not open SQLite: %s", e)
+	}
+	// each connection to :memory: is a different database
+	d.db.SetMaxOpenConns(1)
+
+	for _, s := range sqliteSchema {
+		if _, e := d.Exec(s); e != nil {
+			t.Fatalf("Could not create schema: %s", e)
+		}
+	}
+	d.setMetadata(testMetadata())
+	return d
+}
+
+func TestSQLiteWriteAndQuery(t *testing.T) {
+	d := sqliteDatabase(t)
+	defer d.db.Close()
+
+	author := DataObjectMap{"ClassName": "Member", "FirstName": "Sam"}
+	if e := d.Write(author); e != nil {
+		t.Fatalf("Unexpected error writing member: %s", e)
+	}
+
+	for _, title := range []string{"First", "Second", "first"} {
+		post := DataObjectMap{"ClassName": "BlogPage", "Title": title, "Date": "2013-01-01", "AuthorID": author["ID"]}
+		if e := d.Write(post); e != nil {
+			t.Fatalf("Unexpected error writing post: %s", e)
+		}
+		if post["ID"] == 0 {
+			t.Errorf("Expected written post to have an ID")
+		}
+	}
+
+	posts := func() DataQuery {
+		return d.NewQuery("BlogPage").SetReadingMode(Stage)
+	}
+
+	if n, e := posts().(*DataQuerySQL).Count(); e != nil || n != 3 {
+		t.Errorf("Expected 3 posts, got %d, %v", n, e)
+	}
+	if n, e := posts().Filter(map[string]interface{}{"Title:case": "First"}).(*DataQuerySQL).Count(); e != nil || n != 1 {
+		t.Errorf("Expected 1 case sensitive match, got %d, %v", n, e)
+	}
+
+	res, e := posts().Sort("Title").Limit(1, 1).Run()
+	if e != nil {
+		t.Fatalf("Unexpected error %s", e)
+	}
+	items, _ := res.(DataList).Items()
+	if len(items) != 1 || data.Eval(items[0], "Title") != "Second" {
+		t.Errorf("Expected second post by title, got %v", items)
+	}
+
+	if e := d.Delete(items[0]); e != nil {
+		t.Errorf("Unexpected error deleting: %s", e)
+	}
+	if n, _ := posts().(*DataQuerySQL).Count(); n != 2 {
+		t.Errorf("Expected 2 posts after delete, got %d", n)
+	}
+	if n, _ := d.NewQuery("BlogPage").SetReadingMode(AllVersions).(*DataQuerySQL).Count(); n != 3 {
+		t.Errorf("Expected a version of each post written, got %d", n)
+	}
+}
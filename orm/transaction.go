@@ -0,0 +1,177 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// Tx is a transaction on a database. Queries created with Tx.NewQuery, and objects written with
+// Tx.Write and Tx.Delete, are part of the transaction, so they see its uncommitted changes and
+// are committed or rolled back together. A Tx is only valid within the function passed to
+// Transaction, and must not be used by more than one go-routine at a time.
+type Tx struct {
+	db *Database
+	tx *sql.Tx
+
+	// The context of the transaction, which Query, Exec, Write and Delete use.
+	ctx context.Context
+
+	// The nesting depth of the transaction. 0 is the outermost transaction; nested transactions are
+	// savepoints within it.
+	depth int
+}
+
+// Transaction calls fn with a new transaction on the default database. If fn returns nil the
+// transaction is committed, otherwise it is rolled back and the error returned. If fn panics, the
+// transaction is rolled back and the panic continues.
+//
+//	e := orm.Transaction(func(tx *orm.Tx) error {
+//		page, e := tx.NewQuery("Page").Where("\"SiteTree\".\"ID\"=?", id).Run()
+//		...
+//		return tx.Write(page)
+//	})
+func Transaction(fn func(tx *Tx) error) error {
+	return defaultDatabase().Transaction(fn)
+}
+
+// TransactionContext is Transaction with a context. If the context is done before the transaction is
+// committed, the transaction is rolled back.
+func TransactionContext(ctx context.Context, fn func(tx *Tx) error) error {
+	return defaultDatabase().TransactionContext(ctx, fn)
+}
+
+// Transaction calls fn with a new transaction on this database. See Transaction.
+func (d *Database) Transaction(fn func(tx *Tx) error) error {
+	return d.TransactionContext(context.Background(), fn)
+}
+
+// TransactionContext calls fn with a new transaction on this database. See TransactionContext.
+func (d *Database) TransactionContext(ctx context.Context, fn func(tx *Tx) error) error {
+	if d == nil {
+		return errNoDatabase
+	}
+	t, e := d.db.BeginTx(ctx, nil)
+	if e != nil {
+		return e
+	}
+	tx := &Tx{db: d, tx: t, ctx: ctx}
+
+	committed := false
+	defer func() {
+		if !committed {
+			t.Rollback()
+		}
+	}()
+
+	if e = fn(tx); e != nil {
+		return e
+	}
+	committed = true
+	return t.Commit()
+}
+
+// Transaction calls fn with a transaction nested in this one, using a savepoint. If fn returns an
+// error, only the changes made by fn are rolled back, and the error is returned; the outer
+// transaction can carry on or return the error in turn.
+func (tx *Tx) Transaction(fn func(tx *Tx) error) error {
+	savepoint := quoteIdentifier("goss_" + strconv.Itoa(tx.depth+1))
+	if _, e := tx.Exec("savepoint " + savepoint); e != nil {
+		return e
+	}
+	nested := &Tx{db: tx.db, tx: tx.tx, ctx: tx.ctx, depth: tx.depth + 1}
+
+	released := false
+	defer func() {
+		if !released {
+			tx.Exec("rollback to savepoint " + savepoint)
+		}
+	}()
+
+	if e := fn(nested); e != nil {
+		return e
+	}
+	released = true
+	_, e := tx.Exec("release savepoint " + savepoint)
+	return e
+}
+
+// Database returns the database of the transaction.
+func (tx *Tx) Database() *Database {
+	return tx.db
+}
+
+// Query executes a SQL query in the transaction. The rows must be closed before the transaction
+// executes anything else.
+func (tx *Tx) Query(sql string, args ...interface{}) (*sql.Rows, error) {
+	return tx.QueryContext(tx.ctx, sql, args...)
+}
+
+// QueryContext is Query with a context other than the transaction's.
+func (tx *Tx) QueryContext(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, e := tx.queryContext(ctx, sql, args...)
+	tx.db.observe(sql, args, start, -1, e)
+	return rows, e
+}
+
+// Execute a query without observing it, for callers that observe it once its rows are read.
+func (tx *Tx) queryContext(ctx context.Context, sql string, args ...interface{}) (*sql.Rows, error) {
+	return tx.tx.QueryContext(ctx, tx.db.Dialect().Rebind(sql), args...)
+}
+
+// Exec executes a SQL statement in the transaction.
+func (tx *Tx) Exec(sql string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(tx.ctx, sql, args...)
+}
+
+// ExecContext is Exec with a context other than the transaction's.
+func (tx *Tx) ExecContext(ctx context.Context, sql string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, e := tx.tx.ExecContext(ctx, tx.db.Dialect().Rebind(sql), args...)
+	tx.db.observe(sql, args, start, rowsAffected(res), e)
+	return res, e
+}
+
+// Execute a query that returns a single integer, such as a count.
+func (tx *Tx) queryInt(sql string, args ...interface{}) (int, error) {
+	start := time.Now()
+	var n int
+	e := tx.tx.QueryRowContext(tx.ctx, tx.db.Dialect().Rebind(sql), args...).Scan(&n)
+	tx.db.observe(sql, args, start, 1, e)
+	return n, e
+}
+
+// Execute an insert into a table with an ID column, returning the new ID.
+func (tx *Tx) insert(sql string, args ...interface{}) (int64, error) {
+	start := time.Now()
+	id, e := tx.db.Dialect().Insert(tx.ctx, tx.tx, sql, args...)
+	tx.db.observe(sql, args, start, 1, e)
+	return id, e
+}
+
+// NewQuery returns a query for objects of className that is run in the transaction. Run and Each
+// use the context of the transaction. Relations loaded with With are read in the transaction; other
+// relations of the objects it returns are read outside it.
+func (tx *Tx) NewQuery(className string) DataQuery {
+	q := tx.db.NewQuery(className).(*DataQuerySQL)
+	q.tx = tx
+	return q
+}
+
+// Write inserts or updates obj in the transaction. See Write.
+func (tx *Tx) Write(obj interface{}) error {
+	if e := writeObject(tx, tx.db.Metadata(), obj); e != nil {
+		return e
+	}
+	if o, ok := obj.(DatabaseObject); ok {
+		o.SetDatabase(tx.db)
+	}
+	return nil
+}
+
+// Delete removes obj in the transaction. See Delete.
+func (tx *Tx) Delete(obj interface{}) error {
+	return deleteObject(tx, tx.db.Metadata(), obj)
+}
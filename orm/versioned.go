@@ -0,0 +1,89 @@
+package orm
+
+import (
+	"errors"
+	"time"
+)
+
+// This file provides access to the history of versioned objects, which SilverStripe's Versioned extension
+// records in the <Table>_versions tables. Each row in these tables is one version of a record; RecordID
+// is the ID of the object and Version its version number. Queries read these tables using the
+// AllVersions and Archived reading modes, which join the class' _versions tables on RecordID and Version.
+
+// AllVersionsOf returns a query for every version of the object of class className with the given
+// ID in the default database, most recent version first. The ID of each item returned is the object
+// ID; Version identifies the version.
+func AllVersionsOf(className string, id int) (DataQuery, error) {
+	return defaultDatabase().AllVersionsOf(className, id)
+}
+
+// GetVersion returns a specific version of an object in the default database, or nil if there is no
+// such version.
+func GetVersion(className string, id int, version int) (interface{}, error) {
+	return defaultDatabase().GetVersion(className, id, version)
+}
+
+// GetAsAt returns an object in the default database as it was at the given date, which is the latest
+// version that was written at or before that time. Returns nil if the object didn't exist at that date.
+func GetAsAt(className string, id int, date time.Time) (interface{}, error) {
+	return defaultDatabase().GetAsAt(className, id, date)
+}
+
+// AllVersionsOf returns a query for every version of an object in this database.
+func (d *Database) AllVersionsOf(className string, id int) (DataQuery, error) {
+	base, e := d.versionedBaseTable(className)
+	if e != nil {
+		return nil, e
+	}
+
+	q := d.NewQuery(className).SetReadingMode(AllVersions).
+		Where(base+".\"RecordID\"=?", id).
+		Sort(base + ".\"Version\" desc")
+	return q, nil
+}
+
+// GetVersion returns a specific version of an object in this database.
+func (d *Database) GetVersion(className string, id int, version int) (interface{}, error) {
+	q, e := d.AllVersionsOf(className, id)
+	if e != nil {
+		return nil, e
+	}
+
+	base, _ := d.versionedBaseTable(className)
+	return firstItem(q.Where(base+".\"Version\"=?", version))
+}
+
+// GetAsAt returns an object in this database as it was at the given date.
+func (d *Database) GetAsAt(className string, id int, date time.Time) (interface{}, error) {
+	base, e := d.versionedBaseTable(className)
+	if e != nil {
+		return nil, e
+	}
+
+	q := d.NewQuery(className).SetReadingMode(Archived(date)).Where(base+".\"RecordID\"=?", id)
+	return firstItem(q)
+}
+
+// Return the quoted base table alias for a versioned class, or an error if the class is not
+// versioned.
+func (d *Database) versionedBaseTable(className string) (string, error) {
+	ci := d.Metadata().GetClass(className)
+	if ci == nil || !ci.Versioned || ci.baseClass() == nil {
+		return "", errors.New("Class '" + className + "' is not versioned")
+	}
+	return quoteIdentifier(ci.baseClass().TableName), nil
+}
+
+// Run a query and return its first item, or nil if there are none.
+func firstItem(q DataQuery) (interface{}, error) {
+	res, e := q.Limit(0, 1).Run()
+	if e != nil {
+		return nil, e
+	}
+
+	items, e := res.(DataList).Items()
+	if e != nil || len(items) == 0 {
+		return nil, e
+	}
+	return items[0], nil
+}
@@ -0,0 +1,315 @@
+package orm
+
+import (
+	"errors"
+	"github.com/mrmorphic/goss/convert"
+	"github.com/mrmorphic/goss/data"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file handles writing DataObjects back to the database. SilverStripe stores an object across
+// one table per class in its ancestry that has a table. The base table holds ID, ClassName, Created
+// and LastEdited, and allocates the ID. Each subclass table has a row with the same ID holding the
+// fields that subclass declares. Versioned classes also have a Version in the base table, and each
+// write records the new version in the _versions tables, as SilverStripe's Versioned does.
+
+// The format SilverStripe uses for SS_Datetime fields.
+const datetimeFormat = "2006-01-02 15:04:05"
+
+// Fields that are maintained by the ORM in the base table, and never written from the object's own
+// field values.
+var systemFields = map[string]bool{"ID": true, "ClassName": true, "Created": true, "LastEdited": true}
+
+// tableWrite is the set of column values that are written to a single table.
+type tableWrite struct {
+	table   string
+	columns []string
+	values  []interface{}
+}
+
+// Write inserts or updates obj in the database. If obj has a non-zero ID, the existing record is
+// updated, otherwise a new record is inserted and its ID set on obj. obj must have a ClassName
+// that is known in the metadata, and if it's a struct it must be passed by pointer. Created and
+// LastEdited are maintained automatically. All tables are written in a single transaction. For
+// versioned classes, the stage tables are written, not the _Live tables, and the object's Version is
+// incremented and recorded in the _versions tables. An object with an ID that isn't in the database
+// is an error. obj is written to the database it was read from, or the default database.
+func Write(obj interface{}) error {
+	return databaseOf(obj).Write(obj)
+}
+
+// Delete removes obj from each of the tables in its class ancestry, in a single transaction, in the
+// database it was read from, or the default database.
+func Delete(obj interface{}) error {
+	return databaseOf(obj).Delete(obj)
+}
+
+// Write inserts or updates obj in this database, in its own transaction. See Write.
+func (d *Database) Write(obj interface{}) error {
+	return d.Transaction(func(tx *Tx) error {
+		return tx.Write(obj)
+	})
+}
+
+// Delete removes obj from this database, in its own transaction. See Delete.
+func (d *Database) Delete(obj interface{}) error {
+	return d.Transaction(func(tx *Tx) error {
+		return tx.Delete(obj)
+	})
+}
+
+func writeObject(tx *Tx, dbm *DBMetadata, obj interface{}) error {
+	ci, e := classInfoOf(dbm, obj)
+	if e != nil {
+		return e
+	}
+
+	v, _ := fieldValue(obj, "ID")
+	id, e := convert.AsInt(v)
+	if e != nil {
+		return e
+	}
+
+	now := time.Now().Format(datetimeFormat)
+	writes := splitFields(ci, obj)
+
+	// base table. This is always first in the writes.
+	base := writes[0]
+	base.columns = append(base.columns, "ClassName", "LastEdited")
+	base.values = append(base.values, ci.ClassName, now)
+
+	// the new version follows the latest in the _versions table, which may be later than the stage's
+	version := 0
+	if ci.Versioned {
+		if id != 0 {
+			version, e = tx.queryInt("select coalesce(max(\"Version\"),0) from "+quoteIdentifier(base.table+AllVersions.suffix())+" where \"RecordID\"=?", id)
+			if e != nil {
+				return e
+			}
+		}
+		version++
+		base.columns = append(base.columns, "Version")
+		base.values = append(base.values, version)
+	}
+
+	if id == 0 {
+		base.columns = append(base.columns, "Created")
+		base.values = append(base.values, now)
+
+		newID, e := tx.insert(insertSQL(base.table, base.columns), base.values...)
+		if e != nil {
+			return e
+		}
+		id = int(newID)
+		setField(obj, "Created", now)
+	} else {
+		res, e := tx.Exec(updateSQL(base.table, base.columns), append(base.values, id)...)
+		if e != nil {
+			return e
+		}
+		if rowsAffected(res) == 0 {
+			// MySQL only counts rows that changed, so check the row is missing before failing.
+			n, e := tx.queryInt("select count(*) from "+quoteIdentifier(base.table)+" where \"ID\"=?", id)
+			if e != nil {
+				return e
+			}
+			if n == 0 {
+				return errors.New("Cannot write " + ci.ClassName + " " + strconv.Itoa(id) + ", which is not in the database")
+			}
+		}
+	}
+
+	// subclass tables. These may not have a row yet, even on update, if the object's class has changed.
+	for _, w := range writes[1:] {
+		n, e := tx.queryInt("select count(*) from "+quoteIdentifier(w.table)+" where \"ID\"=?", id)
+		if e != nil {
+			return e
+		}
+
+		if n == 0 {
+			_, e = tx.Exec(insertSQL(w.table, append(w.columns, "ID")), append(w.values, id)...)
+		} else if len(w.columns) > 0 {
+			_, e = tx.Exec(updateSQL(w.table, w.columns), append(w.values, id)...)
+		}
+		if e != nil {
+			return e
+		}
+	}
+
+	if ci.Versioned {
+		if e = writeVersion(tx, ci, id, version); e != nil {
+			return e
+		}
+		setField(obj, "Version", version)
+	}
+
+	setField(obj, "ID", id)
+	setField(obj, "LastEdited", now)
+	return nil
+}
+
+// Record a version of an object that has just been written, by copying its rows in the stage tables
+// into the _versions tables.
+func writeVersion(tx *Tx, ci *ClassInfo, id int, version int) error {
+	for i, t := range ci.tables {
+		var columns []string
+		if i == 0 {
+			columns = []string{"ClassName", "Created", "LastEdited"}
+		}
+		for _, f := range t.Fields {
+			if !systemFields[f.Name] && f.Name != "Version" {
+				columns = append(columns, f.Name)
+			}
+		}
+
+		sql := "insert into " + quoteIdentifier(t.TableName+AllVersions.suffix()) +
+			" (" + quoteIdentifiers(append([]string{"RecordID", "Version"}, columns...)) + ")" +
+			" select \"ID\",?"
+		if len(columns) > 0 {
+			sql += "," + quoteIdentifiers(columns)
+		}
+		sql += " from " + quoteIdentifier(t.TableName) + " where \"ID\"=?"
+		if _, e := tx.Exec(sql, version, id); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func deleteObject(tx *Tx, dbm *DBMetadata, obj interface{}) error {
+	ci, e := classInfoOf(dbm, obj)
+	if e != nil {
+		return e
+	}
+
+	v, _ := fieldValue(obj, "ID")
+	id, e := convert.AsInt(v)
+	if e != nil {
+		return e
+	}
+	if id == 0 {
+		return errors.New("Cannot delete an object that has not been written")
+	}
+
+	// delete subclass rows first, base table last.
+	for i := len(ci.tables) - 1; i >= 0; i-- {
+		_, e = tx.Exec("delete from "+quoteIdentifier(ci.tables[i].TableName)+" where \"ID\"=?", id)
+		if e != nil {
+			return e
+		}
+	}
+
+	setField(obj, "ID", 0)
+	return nil
+}
+
+// Return the ClassInfo for the ClassName of obj, or an error if it can't be written.
+func classInfoOf(dbm *DBMetadata, obj interface{}) (*ClassInfo, error) {
+	v, _ := fieldValue(obj, "ClassName")
+	className, _ := v.(string)
+	if className == "" {
+		return nil, errors.New("Cannot write an object without a ClassName")
+	}
+
+	ci := dbm.GetClass(className)
+	if ci == nil {
+		return nil, errors.New("Class '" + className + "' is not in the metadata")
+	}
+	if ci.baseClass() == nil {
+		return nil, errors.New("Class '" + className + "' has no tables")
+	}
+	if ci.InferredAncestry {
+		return nil, errors.New("Class '" + className + "' can't be written, as its ancestry was inferred from the database schema")
+	}
+	return ci, nil
+}
+
+// splitFields determines the values of obj that go into each table of its class ancestry. There is
+// one tableWrite for each table, base table first. Fields that obj doesn't have are left out, so
+// they keep their current (or default) values in the database.
+func splitFields(ci *ClassInfo, obj interface{}) []*tableWrite {
+	var result []*tableWrite
+	for _, c := range ci.tables {
+		w := &tableWrite{table: c.TableName}
+		for _, f := range c.Fields {
+			// the version of versioned classes is set by Write
+			if systemFields[f.Name] || (ci.Versioned && f.Name == "Version") {
+				continue
+			}
+			v, ok := fieldValue(obj, f.Name)
+			if ok {
+				w.columns = append(w.columns, f.Name)
+				w.values = append(w.values, v)
+			}
+		}
+		result = append(result, w)
+	}
+	return result
+}
+
+func insertSQL(table string, columns []string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")
+	return "insert into " + quoteIdentifier(table) + " (" + quoteIdentifiers(columns) + ") values (" + placeholders + ")"
+}
+
+// Generate an update for the columns on the row identified by an ID placeholder, which is bound last.
+func updateSQL(table string, columns []string) string {
+	set := make([]string, len(columns))
+	for i, c := range columns {
+		set[i] = quoteIdentifier(c) + "=?"
+	}
+	return "update " + quoteIdentifier(table) + " set " + strings.Join(set, ",") + " where \"ID\"=?"
+}
+
+// Quote a table or column name. Double quotes in the name are doubled, as ANSI SQL requires, so a
+// name can't end the identifier early. Every dialect uses ANSI quoting, which MySQL only accepts in
+// ANSI_QUOTES mode, so the MySQL dialect refuses data sources that turn it off.
+func quoteIdentifier(name string) string {
+	return "\"" + strings.Replace(name, "\"", "\"\"", -1) + "\""
+}
+
+func quoteIdentifiers(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = quoteIdentifier(n)
+	}
+	return strings.Join(quoted, ",")
+}
+
+// Get a field value from a DataObject, map or struct. The second return value is false if the
+// object doesn't have the field at all, as distinct from having a zero value.
+func fieldValue(obj interface{}, name string) (interface{}, bool) {
+	v := reflect.ValueOf(obj)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		f := v.MapIndex(reflect.ValueOf(name))
+		if !f.IsValid() {
+			return nil, false
+		}
+		return f.Interface(), true
+	case reflect.Struct:
+		return modelFieldValue(obj, name)
+	}
+	return nil, false
+}
+
+// Set a field on obj, using DataObject.Set if it's implemented. Structs are set using their field
+// map, so fields they don't have are ignored.
+func setField(obj interface{}, name string, value interface{}) {
+	if do, ok := obj.(DataObject); ok {
+		do.Set(name, value)
+		return
+	}
+	if reflect.Indirect(reflect.ValueOf(obj)).Kind() == reflect.Struct {
+		setModelField(obj, name, value)
+		return
+	}
+	data.Set(obj, name, value)
+}
@@ -37,9 +37,7 @@ func init() {
 // getConfig is invoked when configuration is provided by the application. We extract out of it what we want,
 // validate, and put the results in the config struct.
 func getConfig(c goss.ConfigProvider) error {
-	fmt.Printf("template.getConfig got %s\n", c)
 	base := c.AsString("goss.ssroot")
-	fmt.Printf("base is %s\n", base)
 	if base == "" {
 		return errors.New("goss template rendering requires configuration property 'ssroot' is set")
 	}
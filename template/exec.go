@@ -1,9 +1,11 @@
 package template
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/mrmorphic/goss"
+	"github.com/mrmorphic/goss/convert"
 	"github.com/mrmorphic/goss/data"
 	"github.com/mrmorphic/goss/orm"
 	"github.com/mrmorphic/goss/url"
@@ -36,6 +38,15 @@ func newExecuter(templates []*compiledTemplate, context interface{}, require gos
 	return exec
 }
 
+// Return the context of the request being rendered. DataLists that are looped over are fetched with
+// this, so their queries are cancelled if the request is.
+func (exec *executer) requestContext() context.Context {
+	if exec.request == nil {
+		return context.Background()
+	}
+	return exec.request.Context()
+}
+
 // push a context onto the context stack
 func (exec *executer) push(context interface{}) {
 	exec.contextStack = append(exec.contextStack, context)
@@ -148,7 +159,7 @@ func (exec *executer) renderChunkVarFunc(ch *chunk) ([]byte, error) {
 		return []byte{}, nil
 	}
 
-	s := fmt.Sprintf("%s", v)
+	s := convert.AsString(v)
 	switch formatterName {
 	case "XML":
 		return []byte(html.EscapeString(s)), nil
@@ -349,15 +360,34 @@ func (exec *executer) renderChunkLoop(ch *chunk) ([]byte, error) {
 		return []byte{}, nil
 	}
 
-	// if ctx implements DataList, get the items.
+	result := []byte{}
+
+	// a DataList marked by Stream is rendered as its rows are read. Any other DataList is read before
+	// the body is rendered, so the body can run queries of its own.
+	if sl, ok := ctxIntf.(*streamedList); ok {
+		e = sl.EachContext(exec.requestContext(), func(item interface{}) error {
+			bytes, e := exec.renderLoopItem(bodyChunk, item)
+			result = append(result, bytes...)
+			return e
+		})
+		if e != nil {
+			return nil, e
+		}
+		return result, nil
+	}
 	if dl, ok := ctxIntf.(orm.DataList); ok {
-		ctxIntf, e = dl.Items()
-		//		fmt.Printf("loop body seeing %d items: %s\n", len(ctxIntf.([]interface{} /*orm.DataObject*/)), ctxIntf)
+		items := []interface{}{}
+		e = dl.EachContext(exec.requestContext(), func(item interface{}) error {
+			items = append(items, item)
+			return nil
+		})
+		if e != nil {
+			return nil, e
+		}
+		ctxIntf = items
 	}
 
-	result := []byte{}
-
-	// we expect ctx to be a slice
+	// otherwise we expect ctx to be a slice
 	ctxV := reflect.ValueOf(ctxIntf)
 
 	// @todo need to handle arrays as well?
@@ -366,28 +396,50 @@ func (exec *executer) renderChunkLoop(ch *chunk) ([]byte, error) {
 	}
 
 	for i := 0; i < ctxV.Len(); i++ {
-		// get the i-th element
-		el := ctxV.Index(i)
-
-		// make this element the context for the loop iteration
-		exec.push(el.Interface())
-
-		// render the chunk with the new context
-		bytes, e := exec.renderChunk(bodyChunk)
+		// render the i-th element
+		bytes, e := exec.renderLoopItem(bodyChunk, ctxV.Index(i).Interface())
 		if e != nil {
 			return nil, e
 		}
 		result = append(result, bytes...)
-
-		_, e = exec.pop()
-		if e != nil {
-			return nil, e
-		}
 	}
 
 	return result, nil
 }
 
+// streamedList is a DataList marked by Stream.
+type streamedList struct {
+	orm.DataList
+}
+
+// Stream marks a DataList so that template loops over it render each item as it is read from the
+// database, instead of reading all of the items first. This keeps large lists out of memory, but the
+// list's query holds a connection until the loop ends, so the body of the loop must not run queries,
+// such as reading a relation of the items or another DataList. Those would need a second connection
+// while the first is held, which deadlocks if the pool allows only one, and fails inside a
+// transaction. Methods like Sort must be applied before Stream, as they return the unmarked list.
+func Stream(list orm.DataList) orm.DataList {
+	return &streamedList{list}
+}
+
+// renderLoopItem renders the body of a loop with item as the context.
+func (exec *executer) renderLoopItem(bodyChunk *chunk, item interface{}) ([]byte, error) {
+	// make this element the context for the loop iteration
+	exec.push(item)
+
+	// render the chunk with the new context
+	bytes, e := exec.renderChunk(bodyChunk)
+	if e != nil {
+		return nil, e
+	}
+
+	_, e = exec.pop()
+	if e != nil {
+		return nil, e
+	}
+	return bytes, nil
+}
+
 // renderRequire is something of a special case. It does not render inline, so returns an empty slice.
 // But it tells the requirements interface to include a new file.
 func (exec *executer) renderRequire(ch *chunk) ([]byte, error) {
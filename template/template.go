@@ -70,7 +70,8 @@ var compiledTemplates map[string]*compiledTemplate
 // RenderWith renders the template(s) using the locator to fill in variable references and writes to the
 // writer. 'templates' is an array of SilverStripe templates minus the ".ss" extension. If there is one template,
 // it is assumed to be in the base templates folder. If two are present, the first is the base template, the
-// second is the $Layout template.
+// second is the $Layout template. The queries of DataLists looped over in the templates use the request's
+// context, so they are cancelled if the client disconnects or the context's deadline passes.
 func RenderWith(w http.ResponseWriter, templates []string, context interface{}, require goss.RequirementsProvider, request *http.Request) error {
 	if require == nil {
 		require = requirements.NewRequirements()
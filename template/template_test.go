@@ -2,12 +2,16 @@ package template
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/mrmorphic/goss"
 	"github.com/mrmorphic/goss/config"
+	"github.com/mrmorphic/goss/orm"
 	"github.com/mrmorphic/goss/requirements"
 	"net/http"
 	"testing"
+	"time"
 )
 
 // responseCapture is a simple ResponseWriter that captures the bytes written to the response.
@@ -34,7 +38,7 @@ func compileAndExecute(source string, context interface{}) ([]byte, error) {
 	if e != nil {
 		return nil, e
 	}
-	exec := newExecuter([]*compiledTemplate{compiled}, context, requirements.NewRequirements())
+	exec := newExecuter([]*compiledTemplate{compiled}, context, requirements.NewRequirements(), nil)
 	return exec.render()
 }
 
@@ -87,7 +91,7 @@ func TestVariants(t *testing.T) {
 		return
 	}
 
-	fmt.Printf("Configuration is %s\n", configuration)
+	fmt.Printf("Configuration is %v\n", configuration)
 
 	sources := []string{
 		"abc$foosdasd",
@@ -156,7 +160,7 @@ func TestExec(t *testing.T) {
 	context["title"] = "dear"
 
 	// evaluate it
-	exec := newExecuter([]*compiledTemplate{compiled}, context, requirements.NewRequirements())
+	exec := newExecuter([]*compiledTemplate{compiled}, context, requirements.NewRequirements(), nil)
 	bytes, e := exec.renderChunk(compiled.chunk)
 
 	if e != nil {
@@ -177,7 +181,7 @@ func TestLayout(t *testing.T) {
 	capture := &responseCapture{}
 	context := make(map[string]interface{})
 
-	e = RenderWith(capture, []string{"TestA", "TestALayout"}, context, nil)
+	e = RenderWith(capture, []string{"TestA", "TestALayout"}, context, nil, nil)
 
 	if string(capture.response) != "startTestALayoutend" {
 		t.Errorf("main/layout response was not expected: %s", capture.response)
@@ -245,6 +249,76 @@ func TestLoop(t *testing.T) {
 	testSourceList(sources, context, t)
 }
 
+func TestGroupedList(t *testing.T) {
+	sources := map[string]string{
+		`<% loop Items.GroupedBy("Category") %>[$Category:<% loop Children %>$Title<% end_loop %>]<% end_loop %>`: `[x:ac][y:b]`,
+	}
+	items := orm.GroupedList{
+		map[string]interface{}{"Title": "a", "Category": "x"},
+		map[string]interface{}{"Title": "b", "Category": "y"},
+		map[string]interface{}{"Title": "c", "Category": "x"},
+	}
+	testSourceList(sources, map[string]interface{}{"Items": items}, t)
+}
+
+// singleConnList is a DataList whose items are read over the only connection of a pool, which is
+// held while the items are being read.
+type singleConnList struct {
+	orm.DataList
+	held  *bool
+	items []interface{}
+}
+
+func (l *singleConnList) EachContext(ctx context.Context, fn func(interface{}) error) error {
+	*l.held = true
+	defer func() { *l.held = false }()
+	for _, item := range l.items {
+		if e := fn(item); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// nestedQueryItem runs a query of its own when Tags is rendered, which fails if the connection is held.
+type nestedQueryItem struct {
+	Title string
+	held  *bool
+}
+
+func (i *nestedQueryItem) Tags() (string, error) {
+	if *i.held {
+		return "", errors.New("nested query while the connection is held")
+	}
+	return "tags of " + i.Title, nil
+}
+
+func TestLoopNestedQuery(t *testing.T) {
+	held := false
+	list := &singleConnList{held: &held}
+	for _, title := range []string{"a", "b"} {
+		list.items = append(list.items, &nestedQueryItem{Title: title, held: &held})
+	}
+
+	source := `<% loop List %>[$Title:$Tags]<% end_loop %>`
+	testSourceList(map[string]string{source: `[a:tags of a][b:tags of b]`}, map[string]interface{}{"List": list}, t)
+
+	// a streamed list holds the connection while the body is rendered, so the nested query fails
+	testSourceList(map[string]string{source: `[a:][b:]`}, map[string]interface{}{"List": Stream(list)}, t)
+}
+
+func TestTypedFields(t *testing.T) {
+	sources := map[string]string{
+		`$ID $Price $ShowInMenus $Created [$Missing]`: `5 1.5 1 2013-06-01 12:00:00 []`,
+	}
+	context := orm.DataObjectMap{"ID": 5, "Price": 1.5, "ShowInMenus": true, "Created": time.Date(2013, 6, 1, 12, 0, 0, 0, time.UTC)}
+	testSourceList(sources, context, t)
+
+	if s := context.GetStr("ID"); s != "5" {
+		t.Errorf("Expected GetStr of an int field to be its digits, got %s", s)
+	}
+}
+
 func TestRequireJS(t *testing.T) {
 	source := `<html><head><title>x</title></head><body><% require javascript("themes/simple/javascript/test.js") %><div>test</div></body></html>`
 	context := map[string]interface{}{}